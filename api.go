@@ -3,7 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"text/template"
+	"time"
 )
 
 // ErrorAPI defines a struct that is returned on API errors.
@@ -23,22 +27,84 @@ func newErrorAPI(status int, message string) string {
 	return string(j)
 }
 
+// PlayAPI defines a struct that describes a track or an episode that a
+// user has played.
+type PlayAPI struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Artists string `json:"artists"`
+	Album   string `json:"album,omitempty"`
+	URL     string `json:"url"`
+	Image   string `json:"image,omitempty"`
+}
+
+// NotPlayingAPI defines a struct that is returned when the user isn't
+// playing anything. It contains the same error as older versions of the
+// API returned, together with the last item the user played, if any.
+type NotPlayingAPI struct {
+	Error        ErrorObject `json:"error"`
+	LastPlayed   interface{} `json:"last_played,omitempty"`
+	LastPlayedAt *time.Time  `json:"last_played_at,omitempty"`
+}
+
+// newNotPlayingAPI returns a JSON encoded NotPlayingAPI object for the
+// given user id. The last played item is returned as a PlayAPI object, or
+// as a formatted text if short is true.
+func (a *app) newNotPlayingAPI(id string, short bool) string {
+	n := &NotPlayingAPI{}
+	n.Error.Status = http.StatusOK
+	n.Error.Message = "user is not playing anything"
+
+	p, err := a.getLastPlay(id)
+	if err != nil {
+		log.Printf("can't get last play for %s: %v", id, err)
+	}
+	if p != nil {
+		if short {
+			n.LastPlayed = fmt.Sprintf("%s - %s @ %s", p.Artists, p.Name, p.URL)
+		} else {
+			n.LastPlayed = &PlayAPI{
+				Type:    p.ItemType,
+				ID:      p.ItemID,
+				Name:    p.Name,
+				Artists: p.Artists,
+				Album:   p.Album,
+				URL:     p.URL,
+				Image:   p.ImageURL,
+			}
+		}
+		n.LastPlayedAt = &p.UpdatedAt
+	}
+
+	j, _ := json.Marshal(n)
+	return string(j)
+}
+
 // currentlyPlayingAPI returns the song that the given user id is currently
 // playing.
 func (a *app) currentlyPlayingAPI(w http.ResponseWriter, r *http.Request, id string) {
-	// Get the access and refresh tokens from the database for
-	// the given user.
-	// If the tokens are empty we'll know that the user hasn't authorized
+	// Get the currently playing object for the requested user id.
+	// The object is served from the cache if it has been fetched
+	// recently, and the last known object is served if Spotify can't
+	// be reached.
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	// If there is no token we'll know that the user hasn't authorized
 	// his/her account.
-	at, rt := a.getTokens(id)
-	if at == "" {
+	if err == errNotAuthorized {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
 		return
 	}
 
-	// Get the currently playing object for the requested user id.
-	cpo, err := a.getCurrentlyPlayingObject(id, at, rt)
+	// Spotify is rate limiting us or is having problems, tell the client
+	// when to try again.
+	if writeUnavailable(w, err) {
+		fmt.Fprintf(w, newErrorAPI(http.StatusServiceUnavailable, "spotify is temporarily unavailable"))
+		return
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "internal server error"))
@@ -48,30 +114,86 @@ func (a *app) currentlyPlayingAPI(w http.ResponseWriter, r *http.Request, id str
 	// This case means that the user isn't currently playing anything.
 	if cpo == nil && err == nil {
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, newErrorAPI(http.StatusOK, "user is not playing anything"))
+		fmt.Fprint(w, a.newNotPlayingAPI(id, false))
+		return
+	}
+
+	// Mark the object as stale if it's the last known object and describe
+	// the progress if it's an episode.
+	fields := map[string]interface{}{}
+	if stale != nil {
+		fields["stale"] = true
+		fields["stale_age"] = int(stale.age().Seconds())
+	}
+	if e := newEpisodeAPI(cpo, fetchedAt, time.Now()); e != nil {
+		fields["episode"] = e
+	}
+
+	j, err := marshalWithFields(publicCurrentlyPlayingObject(cpo), fields)
+	if err != nil {
+		log.Printf("can't encode currently playing object for %s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "internal server error"))
 		return
 	}
+	w.Write(j)
+}
+
+// marshalWithFields returns the JSON encoded currently playing object with
+// the given fields added to it.
+func marshalWithFields(cpo *CurrentlyPlayingObject, fields map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(cpo)
+	if err != nil || len(fields) == 0 {
+		return data, err
+	}
 
-	j, _ := json.Marshal(cpo)
-	fmt.Fprintf(w, string(j))
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		out[k] = v
+	}
+	return json.Marshal(out)
 }
 
 // currentlyPlayingShortAPI returns a formatted text with the currently
-// playing song for the given user.
+// playing song for the given user. The text can be formatted with a
+// template in the format parameter, or with the default format that the
+// user has stored, and it's returned as plain text instead of JSON if
+// plain is set to 1.
 func (a *app) currentlyPlayingShortAPI(w http.ResponseWriter, r *http.Request, id string) {
-	// Get the access and refresh tokens from the database for
-	// the given user.
-	// If the tokens are empty we'll know that the user hasn't authorized
+	// Parse the format before anything else so that an invalid format is
+	// reported even if the user isn't playing anything.
+	format, err := a.shortFormat(r, id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, newErrorAPI(http.StatusBadRequest, fmt.Sprintf("invalid format: %v", err)))
+		return
+	}
+	plain := r.FormValue("plain") == "1"
+
+	// Get the currently playing object for the requested user id.
+	// The object is served from the cache if it has been fetched
+	// recently, and the last known object is served if Spotify can't
+	// be reached.
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	// If there is no token we'll know that the user hasn't authorized
 	// his/her account.
-	at, rt := a.getTokens(id)
-	if at == "" {
+	if err == errNotAuthorized {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
 		return
 	}
 
-	// Get the currently playing object for the requested user id.
-	cpo, err := a.getCurrentlyPlayingObject(id, at, rt)
+	// Spotify is rate limiting us or is having problems, tell the client
+	// when to try again.
+	if writeUnavailable(w, err) {
+		fmt.Fprintf(w, newErrorAPI(http.StatusServiceUnavailable, "spotify is temporarily unavailable"))
+		return
+	}
+
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "internal server error"))
@@ -80,33 +202,157 @@ func (a *app) currentlyPlayingShortAPI(w http.ResponseWriter, r *http.Request, i
 
 	// This case means that the user isn't currently playing anything.
 	if (cpo == nil && err == nil) || (!cpo.IsPlaying) {
+		if plain {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "user is not playing anything")
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, newErrorAPI(http.StatusOK, "user is not playing anything"))
+		fmt.Fprint(w, a.newNotPlayingAPI(id, true))
 		return
 	}
 
-	// Format the data.
-	var artists string
+	// There's no point in asking Spotify for the context if it couldn't
+	// be reached a moment ago.
+	var pc *playingContext
+	if stale == nil {
+		if pc, err = a.resolveContext(id, cpo.Context); err != nil {
+			log.Printf("can't resolve context for %s: %v", id, err)
+		}
+	}
 
-	if cpo.Item.Type == "track" {
-		for _, a := range cpo.Item.Artists {
-			if len(artists) == 0 {
-				artists = a.Name
-			} else {
-				artists = artists + ", " + a.Name
-			}
+	// Format the data, ads and unknown items can't be described so we'll
+	// tell what kind of item it is instead.
+	var message string
+	if format != nil {
+		d := newShortFormatData(id, cpo, pc, stale != nil, fetchedAt, time.Now())
+		if message, err = executeShortFormat(format, d); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, newErrorAPI(http.StatusBadRequest, fmt.Sprintf("invalid format: %v", err)))
+			return
 		}
+	} else if item := newPlayingItem(cpo); item != nil {
+		message = fmt.Sprintf("%s - %s", item.Artists, item.Name)
+		if item.URL != "" {
+			message += " @ " + item.URL
+		}
+		message += " / " + item.URI
 	} else {
-		artists = cpo.Item.Show.Name
+		message = undescribedItemText(cpo)
 	}
 
-	url := cpo.Item.ExternalURLs["spotify"]
-	uri := cpo.Item.ID
-	track := cpo.Item.Name
-	message := fmt.Sprintf("%s - %s @ %s / spotify:track:%s", artists, track, url, uri)
+	if plain {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, message)
+		return
+	}
 
 	// Wrap it in a map that we can JSON encode and return it.
-	out := map[string]string{"playing": message}
+	out := map[string]interface{}{"playing": message}
+	if e := newEpisodeAPI(cpo, fetchedAt, time.Now()); e != nil {
+		out["remaining"] = formatRemaining(e.RemainingMS)
+		out["deep_link"] = e.DeepLink
+	}
+	if d := deviceName(cpo.Device); d != "" {
+		out["device"] = d
+	}
+	if pc != nil {
+		out["context"] = pc.String()
+	}
+	if stale != nil {
+		out["stale"] = true
+		out["stale_age"] = int(stale.age().Seconds())
+	}
 	j, _ := json.Marshal(out)
-	fmt.Fprintf(w, string(j))
+	w.Write(j)
+}
+
+// shortFormat returns the format for the short API, the format parameter
+// takes precedence over the default format of the user. Nil is returned if
+// there is neither, an error is only returned for an invalid parameter.
+func (a *app) shortFormat(r *http.Request, id string) (*template.Template, error) {
+	if f := r.FormValue("format"); f != "" {
+		return parseShortFormat(f)
+	}
+
+	f, err := a.getShortFormat(id)
+	if err != nil {
+		log.Printf("can't get short format for %s: %v", id, err)
+	}
+	if f == "" {
+		return nil, nil
+	}
+
+	t, err := parseShortFormat(f)
+	if err != nil {
+		log.Printf("stored short format for %s is invalid: %v", id, err)
+		return nil, nil
+	}
+	return t, nil
+}
+
+// recentlyPlayedAPI returns the tracks that the given user id has played
+// recently. The number of tracks can be set with the limit parameter and
+// the before and after parameters can be used to page through the
+// tracks, they're unix timestamps in milliseconds.
+func (a *app) recentlyPlayedAPI(w http.ResponseWriter, r *http.Request, id string) {
+	limit := 20
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 50 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, newErrorAPI(http.StatusBadRequest, "limit must be between 1 and 50"))
+			return
+		}
+	}
+
+	before, after := r.FormValue("before"), r.FormValue("after")
+	if before != "" && after != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, newErrorAPI(http.StatusBadRequest, "only one of before and after can be set"))
+		return
+	}
+	for _, c := range []string{before, after} {
+		if _, err := strconv.ParseInt(c, 10, 64); c != "" && err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, newErrorAPI(http.StatusBadRequest, "before and after must be unix timestamps in milliseconds"))
+			return
+		}
+	}
+
+	// Make sure that the user has authorized lyssnar and that the user
+	// has granted us access to the recently played tracks, accounts that
+	// were authorized before the scope was added have to re-authorize.
+	t := a.getToken(id)
+	if t == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
+		return
+	}
+	if !featureRecentlyPlayed.enabled(t) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, newErrorAPI(http.StatusForbidden, "the user has to re-authorize lyssnar to grant the "+featureRecentlyPlayed.scope+" scope"))
+		return
+	}
+
+	rpo, err := a.cachedRecentlyPlayedObject(w, id, limit, before, after)
+	if err == errNotAuthorized {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
+		return
+	}
+
+	if writeUnavailable(w, err) {
+		fmt.Fprintf(w, newErrorAPI(http.StatusServiceUnavailable, "spotify is temporarily unavailable"))
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "internal server error"))
+		return
+	}
+
+	j, _ := json.Marshal(rpo)
+	w.Write(j)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// percentTrack returns the fake track with a name that would be mangled if
+// it was used as a format string.
+func percentTrack() *CurrentlyPlayingObject {
+	cpo := fakeTrack()
+	cpo.Item.Name = "100% Pure Love"
+	return cpo
+}
+
+func TestNotPlayingLastPlayed(t *testing.T) {
+	a := newTestApp(t, fakeStepNothing)
+	authorizeTestUser(t, a, "")
+	if err := a.recordPlay("alice", percentTrack(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/v1/user/alice/currently-playing", nil))
+	var n struct {
+		LastPlayed PlayAPI `json:"last_played"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &n); err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body, err)
+	}
+	if n.LastPlayed.Name != "100% Pure Love" {
+		t.Errorf("got last played %q", n.LastPlayed.Name)
+	}
+
+	w = serve(a, httptest.NewRequest(http.MethodGet, "/v1/user/alice/currently-playing-short", nil))
+	var short struct {
+		LastPlayed string `json:"last_played"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &short); err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body, err)
+	}
+	if want := "Kraftwerk - 100% Pure Love @ " + percentTrack().Item.ExternalURLs["spotify"]; short.LastPlayed != want {
+		t.Errorf("got last played %q, want %q", short.LastPlayed, want)
+	}
+}
+
+func TestCurrentlyPlayingHidesDevice(t *testing.T) {
+	a := newTestApp(t, fakeStepTrack)
+	authorizeTestUser(t, a, "")
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/v1/user/alice/currently-playing", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	var v struct {
+		Device map[string]interface{} `json:"device"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Device == nil {
+		t.Fatal("device is missing")
+	}
+	for _, k := range []string{"id", "volume_percent"} {
+		if _, ok := v.Device[k]; ok {
+			t.Errorf("device has %s", k)
+		}
+	}
+}
+
+// cacheTestObject makes the app serve the object for alice from the cache.
+func cacheTestObject(a *app, cpo *CurrentlyPlayingObject) {
+	a.cache = newPlayingCache(time.Minute)
+	a.cache.get("alice", func() (*CurrentlyPlayingObject, error) { return cpo, nil })
+}
+
+func TestNowPlayingPercent(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	cacheTestObject(a, percentTrack())
+
+	if _, n := getNowPlaying(t, a); n == nil || n.Title != "100% Pure Love" {
+		t.Errorf("got %+v", n)
+	}
+}
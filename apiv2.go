@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NowPlayingAPI defines the lyssnar schema for what a user is playing. It
+// doesn't depend on the Spotify schema and it's the same regardless of the
+// kind of item that is playing.
+type NowPlayingAPI struct {
+	// The kind of item, "track", "episode", "chapter", "ad" or
+	// "unknown". Only kind, is_playing and fetched_at are set for ads and
+	// unknown items.
+	Kind string `json:"kind"`
+
+	// The Spotify ID and URI of the item. The ID is empty for local
+	// files.
+	ID  string `json:"id,omitempty"`
+	URI string `json:"uri,omitempty"`
+
+	// The name of the track, episode or chapter.
+	Title string `json:"title,omitempty"`
+
+	// The artists of a track, the show of an episode or the authors of a
+	// chapter.
+	Artists []string `json:"artists,omitempty"`
+
+	// The album of a track or the audiobook of a chapter.
+	Album string `json:"album,omitempty"`
+
+	// The show of an episode.
+	Show string `json:"show,omitempty"`
+
+	// Link to the item on Spotify, empty for local files.
+	URL string `json:"url,omitempty"`
+
+	// The artwork in different sizes, nil if there is none.
+	Artwork *ArtworkAPI `json:"artwork,omitempty"`
+
+	// Whether the item is a local file.
+	IsLocal bool `json:"is_local,omitempty"`
+
+	// Whether the item is playing or paused.
+	IsPlaying bool `json:"is_playing"`
+
+	// The progress into the item and its duration in milliseconds.
+	ProgressMS int `json:"progress_ms"`
+	DurationMS int `json:"duration_ms"`
+
+	// When the item will end if it keeps playing, only set while it's
+	// playing and the information isn't stale.
+	EndsAt *time.Time `json:"ends_at,omitempty"`
+
+	// When the information was fetched from Spotify.
+	FetchedAt time.Time `json:"fetched_at"`
+
+	// Whether the information is the last known one, which is served
+	// when Spotify can't be reached.
+	Stale bool `json:"stale"`
+}
+
+// ArtworkAPI contains links to the artwork of an item in different sizes.
+type ArtworkAPI struct {
+	// Roughly 64 pixels wide.
+	Small string `json:"small,omitempty"`
+
+	// Roughly 300 pixels wide.
+	Medium string `json:"medium,omitempty"`
+
+	// Roughly 640 pixels wide.
+	Large string `json:"large,omitempty"`
+}
+
+// newArtworkAPI picks the small, medium and large images, nil is returned
+// if there are no images.
+func newArtworkAPI(images []ImageObject) *ArtworkAPI {
+	if len(images) == 0 {
+		return nil
+	}
+
+	// The images are sorted widest first.
+	a := &ArtworkAPI{
+		Small:  images[len(images)-1].URL,
+		Medium: imageURL(images),
+		Large:  images[0].URL,
+	}
+	if a.Medium == "" {
+		a.Medium = a.Large
+	}
+	return a
+}
+
+// newNowPlayingAPI converts the currently playing object into the lyssnar
+// schema. The fetched time is when the object was fetched from Spotify and
+// stale tells whether it's the last known object.
+func newNowPlayingAPI(cpo *CurrentlyPlayingObject, fetchedAt, now time.Time, stale bool) *NowPlayingAPI {
+	n := &NowPlayingAPI{
+		Kind:      cpo.CurrentlyPlayingType,
+		IsPlaying: cpo.IsPlaying,
+		FetchedAt: fetchedAt.UTC().Truncate(time.Second),
+		Stale:     stale,
+	}
+
+	item := newPlayingItem(cpo)
+	if item == nil {
+		if n.Kind != "ad" {
+			n.Kind = "unknown"
+		}
+		return n
+	}
+
+	n.Kind = item.Type
+	n.ID = item.ID
+	n.URI = item.URI
+	n.Title = item.Name
+	n.URL = item.URL
+	n.Artwork = newArtworkAPI(item.Images)
+	n.IsLocal = item.IsLocal
+	n.DurationMS = item.DurationMS
+	n.ProgressMS = currentProgress(cpo, item.DurationMS, fetchedAt, now)
+
+	if item.Type == "episode" {
+		n.Show = item.Artists
+	} else {
+		n.Artists = item.ArtistList
+		n.Album = item.Album
+	}
+
+	// We can't tell when a stale item ends, the user may have skipped it
+	// since it was fetched.
+	if n.IsPlaying && n.DurationMS > 0 && !stale {
+		endsAt := now.Add(time.Duration(n.DurationMS-n.ProgressMS) * time.Millisecond).UTC().Truncate(time.Second)
+		n.EndsAt = &endsAt
+	}
+
+	return n
+}
+
+// nowPlayingAPI returns what the given user id is playing in the lyssnar
+// schema. Unlike v1 the status code tells the state: 200 if something is
+// playing or paused, 204 if nothing is, 404 if the user hasn't authorized
+// lyssnar and 503 if Spotify can't be reached and there is nothing to fall
+// back on.
+func (a *app) nowPlayingAPI(w http.ResponseWriter, r *http.Request, id string) {
+	// Get the currently playing object for the requested user id.
+	// The object is served from the cache if it has been fetched
+	// recently, and the last known object is served if Spotify can't
+	// be reached.
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	if err == errNotAuthorized {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
+		return
+	}
+
+	if writeUnavailable(w, err) {
+		fmt.Fprintf(w, newErrorAPI(http.StatusServiceUnavailable, "spotify is temporarily unavailable"))
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "internal server error"))
+		return
+	}
+
+	if cpo == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	n := newNowPlayingAPI(cpo, fetchedAt, time.Now(), stale != nil)
+
+	j, _ := json.Marshal(n)
+	w.Write(j)
+}
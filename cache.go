@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Collection of cache statuses that are reported in the Cache-Status
+// header, see RFC 9211.
+const (
+	cacheHit       = "lyssnar; hit"
+	cacheMiss      = "lyssnar; fwd=miss; stored"
+	cacheCollapsed = "lyssnar; fwd=miss; collapsed"
+	cacheBypass    = "lyssnar; fwd=bypass"
+)
+
+// playingCache is a short-lived in-process cache of currently playing
+// objects keyed by user id. Concurrent misses for the same user are
+// coalesced into one upstream request.
+type playingCache struct {
+	ttl     time.Duration
+	objects *ttlCache[string, *CurrentlyPlayingObject]
+}
+
+// newPlayingCache returns a cache that keeps the objects for the given
+// duration, a zero duration disables the cache but misses are still
+// coalesced.
+func newPlayingCache(ttl time.Duration) *playingCache {
+	return &playingCache{ttl: ttl, objects: newTTLCache[string, *CurrentlyPlayingObject](0)}
+}
+
+// get returns the cached object for the given user id, or calls fetch if
+// there's no fresh object in the cache. The cache status and when the
+// returned object was fetched are returned as well. Errors and Spotify
+// error objects are never cached. Every caller gets its own copy of the
+// object.
+func (c *playingCache) get(id string, fetch func() (*CurrentlyPlayingObject, error)) (*CurrentlyPlayingObject, string, time.Time, error) {
+	cpo, status, fetched, err := c.objects.get(id, func() (*CurrentlyPlayingObject, time.Duration, error) {
+		cpo, err := fetch()
+		if cpo != nil && cpo.Error != nil {
+			return cpo, 0, err
+		}
+		return cpo, c.ttl, err
+	})
+	return cpo.clone(), status, fetched, err
+}
+
+// clone returns a deep copy of the object, the cache hands out copies so
+// that callers can't modify the cached object or each other's.
+func (cpo *CurrentlyPlayingObject) clone() *CurrentlyPlayingObject {
+	if cpo == nil {
+		return nil
+	}
+
+	c := &CurrentlyPlayingObject{}
+	data, err := json.Marshal(cpo)
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		log.Printf("can't copy currently playing object: %v", err)
+		*c = *cpo
+	}
+	return c
+}
+
+// cachedCurrentlyPlayingObject returns the currently playing object for the
+// given user id through the cache, together with when it was fetched from
+// Spotify. The cache status is written to the response headers if w isn't
+// nil.
+func (a *app) cachedCurrentlyPlayingObject(w http.ResponseWriter, id string) (*CurrentlyPlayingObject, time.Time, error) {
+	cpo, status, fetchedAt, err := a.cache.get(id, func() (*CurrentlyPlayingObject, error) {
+		return a.getCurrentlyPlayingObject(id)
+	})
+
+	if w != nil {
+		if a.cache.ttl == 0 && status == cacheMiss {
+			status = cacheBypass
+		}
+		w.Header().Set("Cache-Status", status)
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(fetchedAt).Seconds())))
+	}
+
+	return cpo, fetchedAt, err
+}
+
+// Maximum number of entries in the recently played cache, the entries are
+// keyed on the paging parameters as well as the user id.
+const recentlyPlayedCacheSize = 1000
+
+// recentlyPlayedCache is an in-process cache of recently played objects
+// keyed by the user id and the paging parameters. It works like the
+// playingCache, concurrent misses for the same key are coalesced into one
+// upstream request.
+type recentlyPlayedCache struct {
+	ttl     time.Duration
+	objects *ttlCache[string, *RecentlyPlayedObject]
+}
+
+// newRecentlyPlayedCache returns a cache that keeps the objects for the
+// given duration, a zero duration disables the cache but misses are still
+// coalesced.
+func newRecentlyPlayedCache(ttl time.Duration) *recentlyPlayedCache {
+	return &recentlyPlayedCache{ttl: ttl, objects: newTTLCache[string, *RecentlyPlayedObject](recentlyPlayedCacheSize)}
+}
+
+// get returns the cached object for the given key, or calls fetch if
+// there's no fresh object in the cache. The cache status and when the
+// returned object was fetched are returned as well. Errors are never cached
+// and every caller gets its own copy of the object.
+func (c *recentlyPlayedCache) get(key string, fetch func() (*RecentlyPlayedObject, error)) (*RecentlyPlayedObject, string, time.Time, error) {
+	rpo, status, fetched, err := c.objects.get(key, func() (*RecentlyPlayedObject, time.Duration, error) {
+		rpo, err := fetch()
+		return rpo, c.ttl, err
+	})
+	return rpo.clone(), status, fetched, err
+}
+
+// clone returns a deep copy of the object.
+func (rpo *RecentlyPlayedObject) clone() *RecentlyPlayedObject {
+	if rpo == nil {
+		return nil
+	}
+
+	c := &RecentlyPlayedObject{}
+	data, err := json.Marshal(rpo)
+	if err == nil {
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		log.Printf("can't copy recently played object: %v", err)
+		*c = *rpo
+	}
+	return c
+}
+
+// cachedRecentlyPlayedObject returns the recently played object for the
+// given user id through the cache, see getRecentlyPlayedObject for the
+// parameters. The cache status is written to the response headers if w
+// isn't nil.
+func (a *app) cachedRecentlyPlayedObject(w http.ResponseWriter, id string, limit int, before, after string) (*RecentlyPlayedObject, error) {
+	key := fmt.Sprintf("%s?limit=%d&before=%s&after=%s", id, limit, before, after)
+	rpo, status, fetchedAt, err := a.recent.get(key, func() (*RecentlyPlayedObject, error) {
+		return a.getRecentlyPlayedObject(id, limit, before, after)
+	})
+
+	if w != nil {
+		if a.recent.ttl == 0 && status == cacheMiss {
+			status = cacheBypass
+		}
+		w.Header().Set("Cache-Status", status)
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(fetchedAt).Seconds())))
+	}
+
+	return rpo, err
+}
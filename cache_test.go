@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlayingCacheCoalesces(t *testing.T) {
+	c := newPlayingCache(time.Minute)
+
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	fetch := func() (*CurrentlyPlayingObject, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return fakeTrack(), nil
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]string, 5)
+	objects := make([]*CurrentlyPlayingObject, 5)
+	get := func(i int) {
+		defer wg.Done()
+		objects[i], statuses[i], _, _ = c.get("alice", fetch)
+	}
+
+	wg.Add(1)
+	go get(0)
+	<-started
+	for i := 1; i < len(statuses); i++ {
+		wg.Add(1)
+		go get(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fetched %d times, want 1", calls)
+	}
+	if statuses[0] != cacheMiss {
+		t.Errorf("got status %q for the first caller, want %q", statuses[0], cacheMiss)
+	}
+	for i, s := range statuses[1:] {
+		if s != cacheCollapsed && s != cacheHit {
+			t.Errorf("got status %q for caller %d", s, i+1)
+		}
+	}
+
+	// Every caller gets its own copy.
+	objects[0].Item.Name = "changed"
+	for _, o := range objects[1:] {
+		if o.Item.Name != "Europe Endless" {
+			t.Errorf("copy was changed to %q", o.Item.Name)
+		}
+	}
+
+	cpo, status, _, _ := c.get("alice", fetch)
+	if status != cacheHit || calls != 1 || cpo.Item.Name != "Europe Endless" {
+		t.Errorf("got status %q and %q after %d fetches", status, cpo.Item.Name, calls)
+	}
+}
+
+func TestPlayingCacheDoesNotCacheErrors(t *testing.T) {
+	c := newPlayingCache(time.Minute)
+
+	var calls int
+	failing := []func() (*CurrentlyPlayingObject, error){
+		func() (*CurrentlyPlayingObject, error) { return nil, errors.New("unavailable") },
+		func() (*CurrentlyPlayingObject, error) {
+			return &CurrentlyPlayingObject{Error: &ErrorObject{Status: 500, Message: "error"}}, nil
+		},
+	}
+	for _, fetch := range failing {
+		for i := 0; i < 2; i++ {
+			_, status, _, _ := c.get("alice", func() (*CurrentlyPlayingObject, error) {
+				calls++
+				return fetch()
+			})
+			if status != cacheMiss {
+				t.Errorf("got status %q for a failed fetch", status)
+			}
+		}
+	}
+	if calls != 4 {
+		t.Errorf("fetched %d times, want 4", calls)
+	}
+}
+
+func TestPlayingCacheReleasesWaitersOnPanic(t *testing.T) {
+	c := newPlayingCache(0)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.get("alice", func() (*CurrentlyPlayingObject, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		_, _, _, err := c.get("alice", func() (*CurrentlyPlayingObject, error) { return fakeTrack(), nil })
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if p := <-panicked; p != "boom" {
+		t.Errorf("got panic %v in the caller that fetched, want boom", p)
+	}
+	select {
+	case err := <-waited:
+		if err != errFetchPanicked {
+			t.Errorf("got %v for the waiting caller, want %v", err, errFetchPanicked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting caller wasn't released")
+	}
+
+	// The next caller fetches again.
+	if cpo, status, _, err := c.get("alice", func() (*CurrentlyPlayingObject, error) { return fakeTrack(), nil }); cpo == nil || status != cacheMiss || err != nil {
+		t.Errorf("got %v, %q and %v after the panic", cpo, status, err)
+	}
+}
+
+func TestTTLCacheEvicts(t *testing.T) {
+	c := newTTLCache[int, int](2)
+	get := func(key int, ttl time.Duration) string {
+		_, status, _, _ := c.get(key, func() (int, time.Duration, error) { return key, ttl, nil })
+		return status
+	}
+
+	get(1, -time.Second)
+	get(2, time.Minute)
+	get(3, time.Minute)
+	if len(c.entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(c.entries))
+	}
+
+	// Values that aren't kept aren't stored.
+	if _, ok := c.entries[1]; ok {
+		t.Error("value that isn't kept was stored")
+	}
+	if s := get(2, time.Minute); s != cacheHit {
+		t.Errorf("got status %q for a fresh value, want %q", s, cacheHit)
+	}
+
+	// An arbitrary value is evicted when none has expired.
+	get(4, time.Minute)
+	if len(c.entries) != 2 {
+		t.Errorf("got %d entries, want 2", len(c.entries))
+	}
+}
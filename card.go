@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Constants used by the album art cache.
+const (
+	// How long fetched art and failed fetches are kept.
+	artCacheTTL        = 24 * time.Hour
+	artCacheFailureTTL = 5 * time.Minute
+
+	// The maximum number of images in the cache and the largest image
+	// that is fetched.
+	artCacheSize    = 500
+	artMaxImageSize = 1 << 20
+)
+
+// card contains what is shown on the now playing cards.
+type card struct {
+	// The status code to respond with.
+	Status int
+
+	// What the user is doing, e.g. "Now playing" or "Last played 5
+	// minutes ago".
+	State string
+
+	// The name of the item and its artists or show. The title is a
+	// message if there's nothing to show.
+	Title    string
+	Subtitle string
+
+	// Link to the item on Spotify, empty if there is none.
+	URL string
+
+	// The album, show or audiobook art, empty if there is none.
+	ImageURL string
+
+	// The art in all sizes, widest first. Only set for the item that is
+	// playing.
+	Images []ImageObject
+
+	// The progress into the item and its duration, the duration is zero
+	// if there's no progress to show.
+	ProgressMS int
+	DurationMS int
+
+	// Whether the item is playing right now, i.e. it isn't paused, stale
+	// or the last played item.
+	Playing bool
+}
+
+// progress returns the progress as a fraction between 0 and 1.
+func (c *card) progress() float64 {
+	if c.DurationMS <= 0 {
+		return 0
+	}
+	return float64(c.ProgressMS) / float64(c.DurationMS)
+}
+
+// newCard returns the card for the given user id. The card describes the
+// error if the user can't be shown, the status tells which error it is.
+func (a *app) newCard(w http.ResponseWriter, id string) *card {
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	if err == errNotAuthorized {
+		return &card{Status: http.StatusNotFound, State: id, Title: "Not on lyssnar yet"}
+	}
+
+	if setRetryAfter(w, err) {
+		return &card{Status: http.StatusServiceUnavailable, State: id, Title: "Spotify is unavailable"}
+	}
+
+	if err != nil {
+		return &card{Status: http.StatusInternalServerError, State: id, Title: "Something went wrong"}
+	}
+
+	// Show the last item the user played if the user isn't playing
+	// anything.
+	if cpo == nil {
+		p, err := a.getLastPlay(id)
+		if err != nil {
+			log.Printf("can't get last play for %s: %v", id, err)
+		}
+		if p == nil {
+			return &card{Status: http.StatusOK, State: id, Title: "Not playing"}
+		}
+		return &card{
+			Status:   http.StatusOK,
+			State:    "Last played " + timeAgo(time.Since(p.UpdatedAt)),
+			Title:    p.Name,
+			Subtitle: p.Artists,
+			URL:      p.URL,
+			ImageURL: p.ImageURL,
+		}
+	}
+
+	c := &card{Status: http.StatusOK, State: "Now playing", Playing: cpo.IsPlaying && stale == nil}
+	switch {
+	case stale != nil:
+		c.State = "Played " + timeAgo(stale.age())
+	case !cpo.IsPlaying:
+		c.State = "Paused"
+	}
+
+	item := newPlayingItem(cpo)
+	if item == nil {
+		c.Title = undescribedItemText(cpo)
+		return c
+	}
+
+	c.Title = item.Name
+	c.Subtitle = item.Artists
+	c.URL = item.URL
+	c.ImageURL = item.Image
+	c.Images = item.Images
+	c.DurationMS = item.DurationMS
+	c.ProgressMS = currentProgress(cpo, item.DurationMS, fetchedAt, time.Now())
+	return c
+}
+
+// imageURLFor returns the art that is best suited to be drawn with the
+// given size in pixels, the smallest image that is at least that large.
+func (c *card) imageURLFor(size int) string {
+	url := ""
+	for _, i := range c.Images {
+		if i.Height >= size || url == "" {
+			url = i.URL
+		}
+	}
+	if url == "" {
+		return c.ImageURL
+	}
+	return url
+}
+
+// remaining returns the time until the item ends.
+func (c *card) remaining() time.Duration {
+	if c.DurationMS <= c.ProgressMS {
+		return 0
+	}
+	return time.Duration(c.DurationMS-c.ProgressMS) * time.Millisecond
+}
+
+// truncate shortens the text to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return strings.TrimSpace(string(r[:n-1])) + "…"
+}
+
+// artCache is an in-process cache of album art keyed by URL, it keeps the
+// cards from fetching the same image from Spotify's CDN over and over.
+// Concurrent misses for the same URL are coalesced into one request.
+type artCache struct {
+	client *http.Client
+	images *ttlCache[string, *artImage]
+}
+
+// artImage is a fetched image, data is nil if the fetch failed.
+type artImage struct {
+	data        []byte
+	contentType string
+}
+
+// newArtCache returns an empty art cache.
+func newArtCache() *artCache {
+	return &artCache{
+		client: &http.Client{Timeout: 5 * time.Second},
+		images: newTTLCache[string, *artImage](artCacheSize),
+	}
+}
+
+// get returns the image at the given URL and its content type, nil is
+// returned if the image can't be fetched. Failures are remembered for a
+// shorter time.
+func (c *artCache) get(url string) ([]byte, string) {
+	if url == "" {
+		return nil, ""
+	}
+
+	i, _, _, err := c.images.get(url, func() (*artImage, time.Duration, error) {
+		data, contentType, err := c.fetch(url)
+		if err != nil {
+			log.Printf("can't fetch art %s: %v", url, err)
+			return &artImage{}, artCacheFailureTTL, nil
+		}
+		return &artImage{data: data, contentType: contentType}, artCacheTTL, nil
+	})
+	if err != nil {
+		return nil, ""
+	}
+	return i.data, i.contentType
+}
+
+// fetch downloads the image at the given URL.
+func (c *artCache) fetch(url string) ([]byte, string, error) {
+	res, err := c.client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return nil, "", fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, artMaxImageSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > artMaxImageSize {
+		return nil, "", fmt.Errorf("image is larger than %d bytes", artMaxImageSize)
+	}
+
+	return data, contentType, nil
+}
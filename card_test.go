@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeArtTransport serves a small PNG for every URL and counts the
+// requests, it stands in for Spotify's CDN.
+type fakeArtTransport struct {
+	requests    int32
+	contentType string
+}
+
+func (f *fakeArtTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&f.requests, 1)
+
+	var b bytes.Buffer
+	png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 64, 64)))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {f.contentType}},
+		Body:       io.NopCloser(&b),
+		Request:    r,
+	}, nil
+}
+
+// useFakeArt makes the art cache of the app fetch the art from a
+// fakeArtTransport.
+func useFakeArt(a *app) *fakeArtTransport {
+	f := &fakeArtTransport{contentType: "image/png"}
+	a.art.client = &http.Client{Transport: f}
+	return f
+}
+
+func TestArtCache(t *testing.T) {
+	a := &app{art: newArtCache()}
+	f := useFakeArt(a)
+
+	for i := 0; i < 2; i++ {
+		if data, contentType := a.art.get("https://i.scdn.co/image/fake-64"); data == nil || contentType != "image/png" {
+			t.Fatalf("got %d bytes of %q", len(data), contentType)
+		}
+	}
+	if f.requests != 1 {
+		t.Errorf("fetched the art %d times, want 1", f.requests)
+	}
+
+	// Failures are remembered as well.
+	f.contentType = "text/html"
+	for i := 0; i < 2; i++ {
+		if data, _ := a.art.get("https://i.scdn.co/image/fake-300"); data != nil {
+			t.Error("got art with the wrong content type")
+		}
+	}
+	if f.requests != 2 {
+		t.Errorf("fetched the art %d times, want 2", f.requests)
+	}
+
+	if data, _ := a.art.get(""); data != nil {
+		t.Error("got art without a URL")
+	}
+}
+
+func TestCardImageURLFor(t *testing.T) {
+	c := &card{ImageURL: "https://i.scdn.co/image/fake-640", Images: fakeTrack().Item.Album.Images}
+
+	tests := []struct {
+		size int
+		want string
+	}{
+		{64, "https://i.scdn.co/image/fake-64"},
+		{65, "https://i.scdn.co/image/fake-300"},
+		{300, "https://i.scdn.co/image/fake-300"},
+		{640, "https://i.scdn.co/image/fake-640"},
+		{1000, "https://i.scdn.co/image/fake-640"},
+	}
+	for _, tt := range tests {
+		if got := c.imageURLFor(tt.size); got != tt.want {
+			t.Errorf("imageURLFor(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+
+	if got := (&card{ImageURL: "last-played"}).imageURLFor(64); got != "last-played" {
+		t.Errorf("got %q without images, want the image URL", got)
+	}
+}
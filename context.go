@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Constants used by the context metadata cache. Playlists, albums and
+// artists rarely change, so their metadata is kept for a long time.
+const (
+	metadataCacheTTL  = time.Hour
+	metadataCacheSize = 1000
+)
+
+// playlistFields are the fields of a playlist that are fetched, the full
+// playlist object includes the first hundred tracks of the playlist which
+// we don't need.
+const playlistFields = "name,external_urls,images,owner(id,display_name)"
+
+// contextEndpoints maps the context types that can be resolved to the
+// Spotify API endpoints that describe them, %s is replaced with the id.
+var contextEndpoints = map[string]string{
+	"playlist": "/v1/playlists/%s?fields=" + playlistFields,
+	"album":    "/v1/albums/%s",
+	"artist":   "/v1/artists/%s",
+	"show":     "/v1/shows/%s",
+}
+
+// playingContext is a context that has been resolved to something that can
+// be shown to a visitor.
+type playingContext struct {
+	// The context type, e.g. "playlist".
+	Type string
+
+	// The name of the playlist, album, artist or show.
+	Name string
+
+	// Who made the context, e.g. the owner of a playlist or the artists
+	// of an album. Can be empty.
+	By string
+
+	// Link to the context on Spotify.
+	URL string
+
+	// The image of the context, can be empty.
+	Image string
+}
+
+// String formats the context as e.g. "the playlist Friday Focus by alice".
+func (c *playingContext) String() string {
+	if c.By == "" {
+		return fmt.Sprintf("the %s %s", c.Type, c.Name)
+	}
+	return fmt.Sprintf("the %s %s by %s", c.Type, c.Name, c.By)
+}
+
+// newPlayingContext returns the playing context for the given metadata.
+func newPlayingContext(typ string, m *ContextMetadataObject) *playingContext {
+	c := &playingContext{
+		Type:  typ,
+		Name:  m.Name,
+		URL:   m.ExternalURLs["spotify"],
+		Image: imageURL(m.Images),
+	}
+
+	switch {
+	case m.Owner != nil && m.Owner.DisplayName != nil && *m.Owner.DisplayName != "":
+		c.By = *m.Owner.DisplayName
+	case m.Owner != nil:
+		c.By = m.Owner.ID
+	case len(m.Artists) > 0:
+		c.By = artistNames(m.Artists)
+	case m.Publisher != "":
+		c.By = m.Publisher
+	}
+
+	return c
+}
+
+// newMetadataCache returns an empty cache of resolved contexts keyed by
+// the context URI, nil is stored for contexts that can't be resolved.
+func newMetadataCache() *ttlCache[string, *playingContext] {
+	return newTTLCache[string, *playingContext](metadataCacheSize)
+}
+
+// contextPath returns the type of the context and the path of the endpoint
+// that describes it, false is returned if the context can't be resolved.
+func contextPath(c *ContextObject) (string, string, bool) {
+	// The URI is either spotify:<type>:<id> or, for older playlists,
+	// spotify:user:<user>:playlist:<id>.
+	parts := strings.Split(c.URI, ":")
+	if len(parts) < 3 || parts[0] != "spotify" {
+		return "", "", false
+	}
+	typ, id := parts[len(parts)-2], parts[len(parts)-1]
+
+	endpoint, ok := contextEndpoints[typ]
+	if !ok || id == "" {
+		return "", "", false
+	}
+	return typ, fmt.Sprintf(endpoint, id), true
+}
+
+// resolveContext resolves the context that the given user id is playing
+// to a name and an image. The metadata is fetched with the user's token,
+// contexts that the token can't read, such as private playlists, can't be
+// resolved. Nil is returned for contexts that can't be resolved.
+func (a *app) resolveContext(id string, c *ContextObject) (*playingContext, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	typ, path, ok := contextPath(c)
+	if !ok {
+		return nil, nil
+	}
+
+	pc, _, _, err := a.contexts.get(c.URI, func() (*playingContext, time.Duration, error) {
+		return a.fetchContext(id, typ, path)
+	})
+	return pc, err
+}
+
+// fetchContext fetches the metadata of the context at the given path with
+// the token of the given user id, it returns the context and how long it
+// should be cached.
+func (a *app) fetchContext(id, typ, path string) (*playingContext, time.Duration, error) {
+	status, d, err := a.getUserResource(id, path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Some contexts, like the playlists Spotify generates for each user,
+	// can't be fetched. Remember that so that we don't ask again.
+	if status == http.StatusNotFound || status == http.StatusForbidden {
+		return nil, metadataCacheTTL, nil
+	}
+
+	m := &ContextMetadataObject{}
+	if err := json.Unmarshal(d, m); err != nil {
+		return nil, 0, err
+	}
+	if status != http.StatusOK || m.Error != nil {
+		return nil, 0, fmt.Errorf("can't get %s, status %d", path, status)
+	}
+
+	return newPlayingContext(typ, m), metadataCacheTTL, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// keyring contains the key encryption keys that are used to encrypt the
+// stored tokens. Each credential is encrypted with its own random data key
+// which in turn is encrypted, wrapped, with the primary key encryption
+// key. The id of the key that wrapped the data key is stored next to it so
+// that old rows can be decrypted after the primary key has been rotated.
+type keyring struct {
+	// The id of the key that is used when new values are encrypted.
+	primary string
+
+	// All known keys indexed by their id.
+	keys map[string][]byte
+}
+
+// parseKeyring parses the primary key and a comma separated list of old
+// keys. Each key is given as <id>:<base64 encoded 32 byte key>. A nil
+// keyring is returned if no primary key is given, which means that the
+// tokens are stored in plaintext.
+func parseKeyring(primary, old string) (*keyring, error) {
+	if primary == "" {
+		if old != "" {
+			return nil, errors.New("old encryption keys given without a primary key")
+		}
+		return nil, nil
+	}
+
+	k := &keyring{keys: make(map[string][]byte)}
+
+	id, err := k.add(primary)
+	if err != nil {
+		return nil, err
+	}
+	k.primary = id
+
+	for _, o := range strings.Split(old, ",") {
+		if o == "" {
+			continue
+		}
+		if _, err := k.add(o); err != nil {
+			return nil, err
+		}
+	}
+
+	return k, nil
+}
+
+// add parses and adds the given key to the keyring, the id of the key is
+// returned.
+func (k *keyring) add(s string) (string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", errors.New("encryption keys must be given as <id>:<base64 encoded key>")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("can't decode encryption key %s: %v", parts[0], err)
+	}
+	if len(key) != 32 {
+		return "", fmt.Errorf("encryption key %s must be 32 bytes, got %d", parts[0], len(key))
+	}
+	if _, ok := k.keys[parts[0]]; ok {
+		return "", fmt.Errorf("encryption key %s is given more than once", parts[0])
+	}
+
+	k.keys[parts[0]] = key
+	return parts[0], nil
+}
+
+// additionalData returns the data that binds an encrypted value to the
+// user id and the column that it's stored in, so that a value can't be
+// decrypted if it's moved to another row or column.
+func additionalData(id, column string) []byte {
+	return []byte(id + "\x00" + column)
+}
+
+// seal encrypts the given values of the given user id with a new data key.
+// Each value is bound to its column, columns and values must be of the
+// same length. The id of the key that wrapped the data key, the wrapped
+// data key and the encrypted values are returned.
+func (k *keyring) seal(id string, columns, values []string) (string, string, []string, error) {
+	if len(columns) != len(values) {
+		return "", "", nil, errors.New("columns and values must be of the same length")
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", "", nil, err
+	}
+
+	wrapped, err := encrypt(k.keys[k.primary], dataKey, additionalData(id, "data_key"))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var out []string
+	for i, v := range values {
+		c, err := encrypt(dataKey, []byte(v), additionalData(id, columns[i]))
+		if err != nil {
+			return "", "", nil, err
+		}
+		out = append(out, c)
+	}
+
+	return k.primary, wrapped, out, nil
+}
+
+// open decrypts the given values of the given user id with the wrapped data
+// key, columns must be the same as when the values were sealed.
+func (k *keyring) open(id, keyID, wrapped string, columns, values []string) ([]string, error) {
+	if len(columns) != len(values) {
+		return nil, errors.New("columns and values must be of the same length")
+	}
+
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %s", keyID)
+	}
+
+	dataKey, err := decrypt(key, wrapped, additionalData(id, "data_key"))
+	if err != nil {
+		return nil, fmt.Errorf("can't unwrap data key: %v", err)
+	}
+
+	var out []string
+	for i, v := range values {
+		p, err := decrypt(dataKey, v, additionalData(id, columns[i]))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, string(p))
+	}
+
+	return out, nil
+}
+
+// encrypt encrypts the plaintext with AES-GCM and returns the base64
+// encoded nonce and ciphertext. The additional data is authenticated but
+// not encrypted, the same data must be given when the value is decrypted.
+func encrypt(key, plaintext, additionalData []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+// decrypt decrypts a value that has been encrypted with encrypt.
+func decrypt(key []byte, value string, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], additionalData)
+}
+
+// newGCM returns an AES-GCM cipher for the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// testKey returns a key for parseKeyring with the given id, the key bytes
+// are all set to b.
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), 32)))
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		primary, old string
+		ok           bool
+	}{
+		{"", "", true},
+		{testKey("a", 1), "", true},
+		{testKey("a", 1), testKey("b", 2) + "," + testKey("c", 3), true},
+		{"", testKey("b", 2), false},
+		{"a", "", false},
+		{"a:not base64", "", false},
+		{"a:" + base64.StdEncoding.EncodeToString([]byte("short")), "", false},
+		{testKey("a", 1), testKey("a", 2), false},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseKeyring(tt.primary, tt.old); (err == nil) != tt.ok {
+			t.Errorf("parseKeyring(%q, %q) returned %v", tt.primary, tt.old, err)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	k, err := parseKeyring(testKey("new", 1), testKey("old", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []string{"access_token", "refresh_token"}
+	keyID, wrapped, sealed, err := k.seal("alice", columns, []string{"at", "rt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "new" {
+		t.Errorf("sealed with key %s, want new", keyID)
+	}
+
+	values, err := k.open("alice", keyID, wrapped, columns, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != "at" || values[1] != "rt" {
+		t.Errorf("got %v, want [at rt]", values)
+	}
+
+	// The values are bound to the user id and their columns.
+	if _, err := k.open("bob", keyID, wrapped, columns, sealed); err == nil {
+		t.Error("opened values that were sealed for another user")
+	}
+	if _, err := k.open("alice", keyID, wrapped, columns, []string{sealed[1], sealed[0]}); err == nil {
+		t.Error("opened values that were moved to another column")
+	}
+	if _, err := k.open("alice", "old", wrapped, columns, sealed); err == nil {
+		t.Error("opened values with the wrong key")
+	}
+	if _, err := k.open("alice", "unknown", wrapped, columns, sealed); err == nil {
+		t.Error("opened values with an unknown key")
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	a := newTestDB(t)
+
+	token := (&oauth2.Token{AccessToken: "at", RefreshToken: "rt", TokenType: "Bearer"}).WithExtra(map[string]interface{}{"scope": "user-read-currently-playing"})
+	if err := a.storeToken("plain", token); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if a.keys, err = parseKeyring(testKey("old", 1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storeToken("alice", token); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.keys, err = parseKeyring(testKey("new", 2), testKey("old", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.rotateKeys(); n != 2 || err != nil {
+		t.Fatalf("rotated %d credentials: %v", n, err)
+	}
+
+	for _, id := range []string{"plain", "alice"} {
+		var keyID string
+		if err := a.db.QueryRow("SELECT key_id FROM credential WHERE id = $1", id).Scan(&keyID); err != nil || keyID != "new" {
+			t.Errorf("%s has key %q: %v", id, keyID, err)
+		}
+		if got := a.getToken(id); got == nil || got.AccessToken != "at" || got.RefreshToken != "rt" || tokenScope(got) != "user-read-currently-playing" {
+			t.Errorf("%s has token %+v", id, got)
+		}
+	}
+
+	// The old key isn't needed once the rows have been rotated.
+	if a.keys, err = parseKeyring(testKey("new", 2), ""); err != nil {
+		t.Fatal(err)
+	}
+	if a.getToken("alice") == nil {
+		t.Error("token can't be decrypted without the old key")
+	}
+}
+
+func TestReplaceTokenAfterRefresh(t *testing.T) {
+	a := newTestDB(t)
+
+	var err error
+	if a.keys, err = parseKeyring(testKey("old", 1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.storeToken("alice", &oauth2.Token{AccessToken: "at1", RefreshToken: "rt1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	token, sealed, err := a.getSealedToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The running server refreshes the token while the keys are rotated,
+	// the revoked refresh token must not be written back.
+	if err := a.updateToken("alice", &oauth2.Token{AccessToken: "at2", RefreshToken: "rt2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.keys, err = parseKeyring(testKey("new", 2), testKey("old", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if replaced, err := a.replaceToken("alice", token, sealed); replaced || err != nil {
+		t.Fatalf("replaced a token that had changed: %v", err)
+	}
+	if got := a.getToken("alice"); got == nil || got.RefreshToken != "rt2" {
+		t.Fatalf("got token %+v, want rt2", got)
+	}
+
+	// The token is read again and rotated.
+	if rotated, err := a.rotateKey("alice"); !rotated || err != nil {
+		t.Fatalf("rotated %v: %v", rotated, err)
+	}
+	if got := a.getToken("alice"); got == nil || got.RefreshToken != "rt2" {
+		t.Errorf("got token %+v, want rt2", got)
+	}
+}
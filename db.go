@@ -2,49 +2,135 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/osm/migrator"
-	"github.com/osm/migrator/repository"
+	"golang.org/x/oauth2"
 )
 
 // initDB initializes the database and runs any migrations that might
 // not have been executed before.
 func (a *app) initDB() error {
 	var err error
-	if a.db, err = sql.Open("postgres", a.dbURL); err != nil {
+	if a.storage, err = newStorage(a.dbURL); err != nil {
+		return err
+	}
+
+	if a.db, err = sql.Open(a.storage.driver(), a.storage.dataSource()); err != nil {
 		return fmt.Errorf("can't initialize database connection: %v", err)
 	}
+	a.db.SetMaxOpenConns(a.storage.maxOpenConns())
 
-	return migrator.ToLatest(a.db, getDatabaseRepository())
+	return migrator.ToLatest(a.db, a.storage.migrations())
+}
+
+// getToken fetches the OAuth token for the given user id, nil is returned
+// if the user hasn't authorized lyssnar. The access and refresh tokens are
+// decrypted if they're stored encrypted.
+func (a *app) getToken(id string) *oauth2.Token {
+	t, _, err := a.getSealedToken(id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("can't get token for %s: %v", id, err)
+		}
+		return nil
+	}
+	return t
 }
 
-// getDatabaseRepository returns a new repository with all the migrations
-// that exists for the database.
-func getDatabaseRepository() repository.Source {
-	return repository.FromMemory(map[int]string{
-		1: "CREATE TABLE migration (version TEXT NOT NULL PRIMARY KEY);",
-		2: "CREATE TABLE credential (id text NOT NULL PRIMARY KEY, access_token text NOT NULL, refresh_token text NOT NULL, created_at timestamp with time zone NOT NULL, updated_at timestamp with time zone);",
-	})
+// sealedToken contains the token columns of a credential as they're
+// stored, so that the row can be updated only if it hasn't changed since
+// it was read.
+type sealedToken struct {
+	accessToken  string
+	refreshToken string
+	keyID        string
 }
 
-// getTokens fetches the access and refresh tokens for the given user id.
-func (a *app) getTokens(id string) (string, string) {
+// getSealedToken fetches and decrypts the OAuth token for the given user
+// id, the token columns are returned as they're stored as well.
+// sql.ErrNoRows is returned if the user hasn't authorized lyssnar.
+func (a *app) getSealedToken(id string) (*oauth2.Token, *sealedToken, error) {
 	var at, rt string
-	a.db.QueryRow("SELECT access_token, refresh_token FROM credential WHERE id = $1", id).Scan(&at, &rt)
-	return at, rt
+	var keyID, dataKey, tokenType, scope sql.NullString
+	var expiry sql.NullTime
+	err := a.db.QueryRow("SELECT access_token, refresh_token, key_id, data_key, token_type, expiry, scope FROM credential WHERE id = $1", id).
+		Scan(&at, &rt, &keyID, &dataKey, &tokenType, &expiry, &scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed := &sealedToken{accessToken: at, refreshToken: rt, keyID: keyID.String}
+
+	if keyID.Valid {
+		if a.keys == nil {
+			return nil, nil, errors.New("tokens are encrypted but no encryption key is configured")
+		}
+
+		tokens, err := a.keys.open(id, keyID.String, dataKey.String, tokenColumns, []string{at, rt})
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't decrypt tokens: %v", err)
+		}
+		at, rt = tokens[0], tokens[1]
+	}
+
+	t := &oauth2.Token{
+		AccessToken:  at,
+		RefreshToken: rt,
+		TokenType:    tokenType.String,
+		Expiry:       expiry.Time,
+	}
+	return t.WithExtra(map[string]interface{}{"scope": scope.String}), sealed, nil
+}
+
+// tokenScope returns the space separated list of scopes that was granted
+// for the given token.
+func tokenScope(t *oauth2.Token) string {
+	scope, _ := t.Extra("scope").(string)
+	return scope
+}
+
+// tokenColumns are the columns of the encrypted tokens, in the order they
+// are sealed.
+var tokenColumns = []string{"access_token", "refresh_token"}
+
+// sealTokens encrypts the given tokens of the given user id with the
+// primary encryption key. The tokens are returned as is together with null
+// key id and data key if no encryption key is configured.
+func (a *app) sealTokens(id, at, rt string) (string, string, sql.NullString, sql.NullString, error) {
+	if a.keys == nil {
+		return at, rt, sql.NullString{}, sql.NullString{}, nil
+	}
+
+	keyID, dataKey, tokens, err := a.keys.seal(id, tokenColumns, []string{at, rt})
+	if err != nil {
+		return "", "", sql.NullString{}, sql.NullString{}, err
+	}
+
+	return tokens[0], tokens[1], sql.NullString{String: keyID, Valid: true}, sql.NullString{String: dataKey, Valid: true}, nil
 }
 
-// updateAccessToken updates the access token for the given user id.
-func (a *app) updateAccessToken(id, at string) error {
-	stmt, err := a.db.Prepare("UPDATE credential SET access_token = $1, updated_at = now() WHERE id = $2")
+// nullTime returns a null time if the given time is zero.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// updateToken encrypts and updates the OAuth token for the given user id.
+func (a *app) updateToken(id string, t *oauth2.Token) error {
+	at, rt, keyID, dataKey, err := a.sealTokens(id, t.AccessToken, t.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := a.db.Prepare("UPDATE credential SET access_token = $1, refresh_token = $2, key_id = $3, data_key = $4, token_type = $5, expiry = $6, scope = $7, updated_at = $8 WHERE id = $9")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(at, id)
+	_, err = stmt.Exec(at, rt, keyID, dataKey, t.TokenType, nullTime(t.Expiry), tokenScope(t), time.Now(), id)
 	if err != nil {
 		return err
 	}
@@ -52,20 +138,24 @@ func (a *app) updateAccessToken(id, at string) error {
 	return nil
 }
 
-// storeTokens stores the access and refresh tokens for the given user id.
-// It will remove the existing entry, if any, before it stores the new
-// values.
-func (a *app) storeTokens(id, at, rt string) error {
+// storeToken stores the OAuth token for the given user id. It will remove
+// the existing entry, if any, before it stores the new values.
+func (a *app) storeToken(id string, t *oauth2.Token) error {
+	at, rt, keyID, dataKey, err := a.sealTokens(id, t.AccessToken, t.RefreshToken)
+	if err != nil {
+		return err
+	}
+
 	a.db.Exec("DELETE FROM credential WHERE id = $1", id)
 
-	stmt, err := a.db.Prepare("INSERT INTO credential VALUES($1, $2, $3, now(), null)")
+	stmt, err := a.db.Prepare("INSERT INTO credential (id, access_token, refresh_token, key_id, data_key, token_type, expiry, scope, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)")
 	if err != nil {
 		fmt.Println("prep" + err.Error())
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(id, at, rt)
+	_, err = stmt.Exec(id, at, rt, keyID, dataKey, t.TokenType, nullTime(t.Expiry), tokenScope(t), time.Now())
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -74,7 +164,207 @@ func (a *app) storeTokens(id, at, rt string) error {
 	return nil
 }
 
-// deleteUser removes the credential for the given user id.
+// rotateKeys re-encrypts the tokens of all credentials with the primary
+// encryption key. The number of rotated credentials is returned. A row is
+// only overwritten if it hasn't changed since it was read, a running server
+// may have refreshed the token in the meantime and the refresh token that
+// was read may have been revoked. Such rows are read again.
+func (a *app) rotateKeys() (int, error) {
+	ids, err := a.getCredentialIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		rotated, err := a.rotateKey(id)
+		if err != nil {
+			return n, err
+		}
+		if rotated {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// How many times a credential is read again if it changes while it's
+// re-encrypted.
+const rotateKeyAttempts = 3
+
+// rotateKey re-encrypts the tokens of the given user id with the primary
+// encryption key, false is returned if the credential has been removed or
+// if it kept changing while it was re-encrypted.
+func (a *app) rotateKey(id string) (bool, error) {
+	for i := 0; i < rotateKeyAttempts; i++ {
+		t, sealed, err := a.getSealedToken(id)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("can't get tokens for %s: %v", id, err)
+		}
+
+		replaced, err := a.replaceToken(id, t, sealed)
+		if err != nil || replaced {
+			return replaced, err
+		}
+	}
+
+	log.Printf("skipping %s, the tokens changed while they were re-encrypted", id)
+	return false, nil
+}
+
+// replaceToken encrypts and updates the OAuth token for the given user id
+// if the stored token columns are still the given ones, false is returned
+// if they have changed.
+func (a *app) replaceToken(id string, t *oauth2.Token, old *sealedToken) (bool, error) {
+	at, rt, keyID, dataKey, err := a.sealTokens(id, t.AccessToken, t.RefreshToken)
+	if err != nil {
+		return false, err
+	}
+
+	// The key id is compared as an empty string since it's null for
+	// plaintext rows.
+	res, err := a.db.Exec("UPDATE credential SET access_token = $1, refresh_token = $2, key_id = $3, data_key = $4, updated_at = $5 WHERE id = $6 AND COALESCE(key_id, '') = $7 AND access_token = $8 AND refresh_token = $9",
+		at, rt, keyID, dataKey, time.Now(), id, old.keyID, old.accessToken, old.refreshToken)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// deleteUser removes the credential and the last known object for the
+// given user id.
 func (a *app) deleteUser(id string) {
 	a.db.Exec("DELETE FROM credential WHERE id = $1", id)
+	a.db.Exec("DELETE FROM last_known WHERE user_id = $1", id)
+	a.lastKnownKeys.forget(id)
+	a.db.Exec("DELETE FROM setting WHERE user_id = $1", id)
+}
+
+// getShortFormat returns the default short format for the given user id,
+// an empty string is returned if the user hasn't set one.
+func (a *app) getShortFormat(id string) (string, error) {
+	var format string
+	err := a.db.QueryRow("SELECT short_format FROM setting WHERE user_id = $1", id).Scan(&format)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return format, err
+}
+
+// storeShortFormat stores the default short format for the given user id,
+// an empty format is stored as is and means that the user has none.
+func (a *app) storeShortFormat(id, format string) error {
+	_, err := a.db.Exec("INSERT INTO setting (user_id, short_format) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET short_format = excluded.short_format", id, format)
+	return err
+}
+
+// getFrameAncestors returns the origins that are allowed to embed the
+// widget of the given user id, an empty string is returned if the user
+// hasn't restricted them.
+func (a *app) getFrameAncestors(id string) (string, error) {
+	var ancestors string
+	err := a.db.QueryRow("SELECT frame_ancestors FROM setting WHERE user_id = $1", id).Scan(&ancestors)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return ancestors, err
+}
+
+// storeFrameAncestors stores the origins that are allowed to embed the
+// widget of the given user id, an empty string allows all origins.
+func (a *app) storeFrameAncestors(id, ancestors string) error {
+	_, err := a.db.Exec("INSERT INTO setting (user_id, short_format, frame_ancestors) VALUES($1, '', $2) ON CONFLICT (user_id) DO UPDATE SET frame_ancestors = excluded.frame_ancestors", id, ancestors)
+	return err
+}
+
+// getCredentialIDs returns the user ids of all stored credentials.
+func (a *app) getCredentialIDs() ([]string, error) {
+	rows, err := a.db.Query("SELECT id FROM credential ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// playColumns are the columns of the play table in the order scanPlay
+// scans them.
+const playColumns = "id, user_id, item_id, item_type, name, artists, album, image_url, url, duration_ms, progress_ms, listened, listened_at, started_at, updated_at"
+
+// scanPlay scans a row with the playColumns into a play.
+func scanPlay(row interface{ Scan(...interface{}) error }) (*play, error) {
+	p := &play{}
+	var listenedAt sql.NullTime
+	if err := row.Scan(&p.ID, &p.UserID, &p.ItemID, &p.ItemType, &p.Name, &p.Artists, &p.Album, &p.ImageURL, &p.URL, &p.DurationMS, &p.ProgressMS, &p.Listened, &listenedAt, &p.StartedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.ListenedAt = listenedAt.Time
+	return p, nil
+}
+
+// getLastPlay returns the most recently started play for the given user
+// id, nil is returned if the user doesn't have any plays yet.
+func (a *app) getLastPlay(userID string) (*play, error) {
+	p, err := scanPlay(a.db.QueryRow("SELECT "+playColumns+" FROM play WHERE user_id = $1 ORDER BY started_at DESC, id DESC LIMIT 1", userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// getListens returns the most recent plays that qualify as listens for the
+// given user id, the most recently started first.
+func (a *app) getListens(userID string, limit int) ([]*play, error) {
+	rows, err := a.db.Query("SELECT "+playColumns+" FROM play WHERE user_id = $1 AND listened ORDER BY started_at DESC, id DESC LIMIT $2", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plays []*play
+	for rows.Next() {
+		p, err := scanPlay(rows)
+		if err != nil {
+			return nil, err
+		}
+		plays = append(plays, p)
+	}
+
+	return plays, rows.Err()
+}
+
+// insertPlay stores a new play and sets the id of the given play to the
+// id that was assigned by the database.
+func (a *app) insertPlay(p *play) error {
+	return a.db.QueryRow("INSERT INTO play (user_id, item_id, item_type, name, artists, album, image_url, url, duration_ms, progress_ms, listened, listened_at, started_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id",
+		p.UserID, p.ItemID, p.ItemType, p.Name, p.Artists, p.Album, p.ImageURL, p.URL, p.DurationMS, p.ProgressMS, p.Listened, nullTime(p.ListenedAt), p.StartedAt, p.UpdatedAt).Scan(&p.ID)
+}
+
+// updatePlay updates the progress of an existing play.
+func (a *app) updatePlay(p *play) error {
+	_, err := a.db.Exec("UPDATE play SET progress_ms = $1, listened = $2, listened_at = $3, updated_at = $4 WHERE id = $5", p.ProgressMS, p.Listened, nullTime(p.ListenedAt), p.UpdatedAt, p.ID)
+	return err
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Constants used by the embeddable widget.
+const (
+	// How often the widget is reloaded when nothing is playing, and the
+	// bounds of the reload when it's timed to the end of the item.
+	embedIdleRefresh = 30 * time.Second
+	embedMinRefresh  = 5 * time.Second
+	embedMaxRefresh  = 10 * time.Minute
+
+	// The maximum number of origins that may embed a user's widget.
+	maxFrameAncestors = 10
+)
+
+// parseFrameAncestors validates a list of origins separated by spaces or
+// commas and returns them separated by spaces. A host may start with a
+// wildcard, e.g. https://*.example.com.
+func parseFrameAncestors(s string) (string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) > maxFrameAncestors {
+		return "", fmt.Errorf("at most %d origins can be given", maxFrameAncestors)
+	}
+
+	for i, f := range fields {
+		u, err := url.Parse(f)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("%q is not an http or https origin", f)
+		}
+		if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return "", fmt.Errorf("%q must be an origin without a path", f)
+		}
+		if strings.ContainsAny(strings.TrimPrefix(u.Host, "*."), "*;'\"") {
+			return "", errors.New("origins can only have a wildcard at the start of the host")
+		}
+		fields[i] = u.Scheme + "://" + u.Host
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// embedRefresh returns when the widget should reload, which is right after
+// the item ends if it's playing.
+func embedRefresh(c *card) time.Duration {
+	if !c.Playing || c.DurationMS == 0 {
+		return embedIdleRefresh
+	}
+
+	d := c.remaining() + time.Second
+	if d < embedMinRefresh {
+		return embedMinRefresh
+	}
+	if d > embedMaxRefresh {
+		return embedMaxRefresh
+	}
+	return d
+}
+
+// embed renders a chrome-less version of the user's page that is meant to
+// be embedded in an iframe. The layout parameter selects the compact or the
+// full layout, theme selects the colors and transparent removes the
+// background.
+func (a *app) embed(w http.ResponseWriter, r *http.Request, id string) {
+	// Only the origins that the user has listed may embed the widget, all
+	// origins may if the user hasn't listed any.
+	ancestors, err := a.getFrameAncestors(id)
+	if err != nil {
+		log.Printf("can't get frame ancestors for %s: %v", id, err)
+	}
+	if ancestors == "" {
+		ancestors = "*"
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+ancestors)
+
+	c := a.newCard(w, id)
+	refresh := embedRefresh(c)
+
+	layout := r.FormValue("layout")
+	if layout != "compact" {
+		layout = "full"
+	}
+
+	transparent := r.FormValue("transparent")
+	data := map[string]interface{}{
+		"id":          id,
+		"pageURL":     a.userURL(id),
+		"card":        c,
+		"theme":       cardThemeFromRequest(r),
+		"layout":      layout,
+		"transparent": transparent == "1" || transparent == "true",
+		"refresh":     int(math.Ceil(refresh.Seconds())),
+	}
+
+	// The progress bar is animated to the end of the item while it's
+	// playing, so that it moves between the reloads.
+	if c.DurationMS > 0 {
+		data["progress"] = fmt.Sprintf("%.2f", c.progress()*100)
+		if c.Playing {
+			data["animation"] = int(math.Ceil(c.remaining().Seconds()))
+		}
+	}
+
+	setCardHeaders(w)
+	w.WriteHeader(c.Status)
+	tEmbed.Execute(w, data)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFrameAncestors(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com/", "https://example.com", true},
+		{"https://a.example.com, http://b.example.com:8080", "https://a.example.com http://b.example.com:8080", true},
+		{"https://*.example.com", "https://*.example.com", true},
+		{"example.com", "", false},
+		{"ftp://example.com", "", false},
+		{"https://", "", false},
+		{"https://example.com/page", "", false},
+		{"https://example.com?x=1", "", false},
+		{"https://example.com#x", "", false},
+		{"https://user@example.com", "", false},
+		{"https://a.*.example.com", "", false},
+		{"https://*", "", false},
+		{"https://example.com;script-src", "", false},
+		{"https://example.com'", "", false},
+		{"'self'", "", false},
+		{strings.TrimSpace(strings.Repeat("https://example.com ", maxFrameAncestors+1)), "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseFrameAncestors(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseFrameAncestors(%q) returned %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseFrameAncestors(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedFrameAncestors(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	cacheTestObject(a, fakeTrack())
+
+	embed := func() *httptest.ResponseRecorder {
+		w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice/embed?layout=compact", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Europe Endless") {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+		return w
+	}
+
+	if csp := embed().Header().Get("Content-Security-Policy"); csp != "frame-ancestors *" {
+		t.Errorf("got %q, want all origins", csp)
+	}
+
+	if err := a.storeFrameAncestors("alice", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if csp := embed().Header().Get("Content-Security-Policy"); csp != "frame-ancestors https://example.com" {
+		t.Errorf("got %q, want the stored origins", csp)
+	}
+}
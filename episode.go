@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// EpisodeAPI describes the episode that a user is listening to and how far
+// into it the user is.
+type EpisodeAPI struct {
+	Description     string `json:"description"`
+	ReleaseDate     string `json:"release_date"`
+	DurationMS      int    `json:"duration_ms"`
+	ProgressMS      int    `json:"progress_ms"`
+	ProgressPercent int    `json:"progress_percent"`
+	RemainingMS     int    `json:"remaining_ms"`
+	DeepLink        string `json:"deep_link"`
+}
+
+// newEpisodeAPI returns the episode details of the currently playing
+// object that was fetched at the given time, nil is returned if it isn't an
+// episode.
+func newEpisodeAPI(cpo *CurrentlyPlayingObject, fetchedAt, now time.Time) *EpisodeAPI {
+	if cpo == nil || cpo.Episode == nil {
+		return nil
+	}
+	ep := cpo.Episode
+
+	progress := currentProgress(cpo, ep.DurationMS, fetchedAt, now)
+	e := &EpisodeAPI{
+		Description: ep.Description,
+		ReleaseDate: ep.ReleaseDate,
+		DurationMS:  ep.DurationMS,
+		ProgressMS:  progress,
+		RemainingMS: ep.DurationMS - progress,
+		DeepLink:    episodeDeepLink(ep.ExternalURLs["spotify"], progress),
+	}
+	if ep.DurationMS > 0 {
+		e.ProgressPercent = progress * 100 / ep.DurationMS
+	}
+	return e
+}
+
+// currentProgress returns the progress into the item of the currently
+// playing object, which was fetched from Spotify at the given time. The
+// progress is moved forward to now if the item is playing, since the object
+// may have been served from the cache, but never past the duration. The
+// timestamp of the object can't be used for this, it's when the playback
+// state last changed rather than when the progress was measured.
+func currentProgress(cpo *CurrentlyPlayingObject, durationMS int, fetchedAt, now time.Time) int {
+	progress := 0
+	if cpo.ProgressMS != nil {
+		progress = *cpo.ProgressMS
+	}
+	if cpo.IsPlaying && !fetchedAt.IsZero() {
+		if elapsed := now.Sub(fetchedAt); elapsed > 0 {
+			progress += int(elapsed.Milliseconds())
+		}
+	}
+	if durationMS > 0 && progress > durationMS {
+		progress = durationMS
+	}
+	return progress
+}
+
+// episodeDeepLink returns a link that opens the episode at the given
+// position.
+func episodeDeepLink(url string, progressMS int) string {
+	if url == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s?t=%d", url, progressMS/1000)
+}
+
+// formatPosition formats the position as e.g. "12:05" or "1:02:03".
+func formatPosition(ms int) string {
+	s := ms / 1000
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// formatRemaining formats the remaining time as e.g. "48 min left".
+func formatRemaining(ms int) string {
+	d := time.Duration(ms) * time.Millisecond
+	switch {
+	case d < time.Minute:
+		return "less than a minute left"
+	case d < time.Hour:
+		return fmt.Sprintf("%d min left", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%d h %d min left", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// formatReleaseDate formats the release date as e.g. "15 September 2023",
+// dates with a lower precision than a day are returned as is.
+func formatReleaseDate(date string) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return date
+	}
+	return t.Format("2 January 2006")
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Collection of steps that can be used in a fake Spotify script.
+const (
+	fakeStepTrack       = "track"
+	fakeStepEpisode     = "episode"
+	fakeStepNothing     = "nothing"
+	fakeStepExpired     = "expired"
+	fakeStepRateLimited = "rate-limited"
+	fakeStepPrivate     = "private"
+	fakeStepChapter     = "chapter"
+	fakeStepLocal       = "local"
+	fakeStepAd          = "ad"
+)
+
+// fakeSpotify is a minimal stand-in for the Spotify accounts and web API
+// that is used for local development and end-to-end tests. Every request
+// to the currently playing endpoint advances the script one step, the
+// script starts over from the beginning when it reaches the end.
+type fakeSpotify struct {
+	mu sync.Mutex
+
+	// The id of the user that authorizes through the fake server.
+	user string
+
+	// The steps that the currently playing endpoint cycles through.
+	script []string
+
+	// The position in the script for each user.
+	pos map[string]int
+
+	// Number of tokens that have been issued, used to make the tokens
+	// unique.
+	issued int
+
+	// Maps the issued access tokens to user ids.
+	accessTokens map[string]string
+
+	// Maps the issued refresh tokens and authorization codes to the
+	// grant they belong to.
+	refreshTokens map[string]*fakeGrant
+	codes         map[string]*fakeGrant
+}
+
+// fakeGrant contains the details of an authorization.
+type fakeGrant struct {
+	// The id of the user that authorized.
+	user string
+
+	// The space separated list of scopes that was granted.
+	scope string
+
+	// The PKCE code challenge that was sent with the authorization
+	// request, if any.
+	challenge string
+}
+
+// newFakeSpotify returns a fake Spotify server that authorizes everyone as
+// the given user and that runs the given script.
+func newFakeSpotify(user string, script []string) *fakeSpotify {
+	if len(script) == 0 {
+		script = []string{fakeStepTrack}
+	}
+
+	return &fakeSpotify{
+		user:          user,
+		script:        script,
+		pos:           make(map[string]int),
+		accessTokens:  make(map[string]string),
+		refreshTokens: make(map[string]*fakeGrant),
+		codes:         make(map[string]*fakeGrant),
+	}
+}
+
+// fakeSpotifyMain is the entry point of the fake-spotify command.
+func fakeSpotifyMain(args []string) {
+	fs := flag.NewFlagSet("fake-spotify", flag.ExitOnError)
+	addr := fs.String("addr", ":8081", "address to listen on")
+	user := fs.String("user", "alice", "id of the user that is authorized")
+	script := fs.String("script", strings.Join([]string{fakeStepTrack, fakeStepEpisode, fakeStepNothing, fakeStepExpired, fakeStepRateLimited}, ","), "comma separated list of steps that the currently playing endpoint cycles through, valid steps are track, episode, chapter, local, ad, nothing, expired, rate-limited and private")
+	fs.Parse(args)
+
+	steps := strings.Split(*script, ",")
+	for _, s := range steps {
+		switch s {
+		case fakeStepTrack, fakeStepEpisode, fakeStepNothing, fakeStepExpired, fakeStepRateLimited, fakeStepPrivate, fakeStepChapter, fakeStepLocal, fakeStepAd:
+		default:
+			log.Fatalf("unknown step %q in script", s)
+		}
+	}
+
+	log.Printf("fake spotify listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, newFakeSpotify(*user, steps)))
+}
+
+// ServeHTTP routes the requests to the fake endpoints.
+func (f *fakeSpotify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/authorize":
+		f.authorize(w, r)
+	case "/api/token":
+		f.token(w, r)
+	case "/v1/me":
+		f.me(w, r)
+	case "/v1/me/player/currently-playing":
+		f.currentlyPlaying(w, r, false)
+	case "/v1/me/player":
+		f.currentlyPlaying(w, r, true)
+	case "/v1/me/player/recently-played":
+		f.recentlyPlayed(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/image/") {
+			f.image(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/playlists/") || strings.HasPrefix(r.URL.Path, "/v1/albums/") {
+			f.metadata(w, r)
+			return
+		}
+		f.writeError(w, http.StatusNotFound, "Service not found")
+	}
+}
+
+// authorize approves the authorization request immediately and redirects
+// back to the redirect uri with a code and the given state.
+func (f *fakeSpotify) authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		f.writeError(w, http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+
+	f.mu.Lock()
+	f.issued++
+	code := fmt.Sprintf("fake-code-%d", f.issued)
+	f.codes[code] = &fakeGrant{user: f.user, scope: r.FormValue("scope"), challenge: r.FormValue("code_challenge")}
+	f.mu.Unlock()
+
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirect.RawQuery = q.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token handles the authorization_code and refresh_token grants.
+func (f *fakeSpotify) token(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var g *fakeGrant
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		// The code can only be used once and the verifier must match
+		// the challenge if PKCE was used.
+		c, ok := f.codes[r.FormValue("code")]
+		delete(f.codes, r.FormValue("code"))
+		if ok && (c.challenge == "" || c.challenge == oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier"))) {
+			g = c
+		}
+	case "refresh_token":
+		// Refresh tokens are rotated, just like Spotify does for
+		// clients that use PKCE.
+		g = f.refreshTokens[r.FormValue("refresh_token")]
+		delete(f.refreshTokens, r.FormValue("refresh_token"))
+	}
+	if g == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Invalid authorization code"})
+		return
+	}
+
+	f.issued++
+	at := fmt.Sprintf("fake-access-token-%d", f.issued)
+	rt := fmt.Sprintf("fake-refresh-token-%d", f.issued)
+	f.accessTokens[at] = g.user
+	f.refreshTokens[rt] = g
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  at,
+		"refresh_token": rt,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"scope":         g.scope,
+	})
+}
+
+// authenticate returns the user id that the bearer token in the request
+// belongs to, an empty string is returned if the token is unknown.
+func (f *fakeSpotify) authenticate(r *http.Request) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+}
+
+// me returns the user object of the authenticated user.
+func (f *fakeSpotify) me(w http.ResponseWriter, r *http.Request) {
+	user := f.authenticate(r)
+	if user == "" {
+		f.writeError(w, http.StatusUnauthorized, "Invalid access token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&UserObject{
+		DisplayName:  &user,
+		ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/user/" + user},
+		HREF:         "https://api.spotify.com/v1/users/" + user,
+		ID:           user,
+		Type:         "user",
+		URI:          "spotify:user:" + user,
+	})
+}
+
+// currentlyPlaying returns the response of the next step in the script.
+// The device, shuffle and repeat state are included if state is true, like
+// the playback state endpoint does. Items that are played in a private
+// session are only visible in the playback state.
+func (f *fakeSpotify) currentlyPlaying(w http.ResponseWriter, r *http.Request, state bool) {
+	user := f.authenticate(r)
+	if user == "" {
+		f.writeError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+
+	f.mu.Lock()
+	step := f.script[f.pos[user]%len(f.script)]
+	f.pos[user]++
+
+	// Invalidate the access token so that the client has to refresh it
+	// before the next request succeeds.
+	if step == fakeStepExpired {
+		delete(f.accessTokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}
+	f.mu.Unlock()
+
+	switch step {
+	case fakeStepTrack:
+		f.writeJSON(w, r, fakePlaybackState(fakeTrack(), state, false))
+	case fakeStepEpisode:
+		f.writeJSON(w, r, fakePlaybackState(fakeEpisode(), state, false))
+	case fakeStepChapter:
+		f.writeJSON(w, r, fakePlaybackState(fakeChapter(), state, false))
+	case fakeStepLocal:
+		f.writeJSON(w, r, fakePlaybackState(fakeLocalTrack(), state, false))
+	case fakeStepAd:
+		f.writeJSON(w, r, fakePlaybackState(fakeAd(), state, false))
+	case fakeStepPrivate:
+		if !state {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f.writeJSON(w, r, fakePlaybackState(fakeTrack(), state, true))
+	case fakeStepNothing:
+		w.WriteHeader(http.StatusNoContent)
+	case fakeStepExpired:
+		f.writeError(w, http.StatusUnauthorized, "The access token expired")
+	case fakeStepRateLimited:
+		w.Header().Set("Retry-After", "5")
+		f.writeError(w, http.StatusTooManyRequests, "API rate limit exceeded")
+	}
+}
+
+// recentlyPlayed returns the fake track played every five minutes before
+// the before cursor, or before now if no cursor is given.
+func (f *fakeSpotify) recentlyPlayed(w http.ResponseWriter, r *http.Request) {
+	if f.authenticate(r) == "" {
+		f.writeError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 || limit > 50 {
+		limit = 20
+	}
+
+	end := time.Now()
+	if before, err := strconv.ParseInt(r.FormValue("before"), 10, 64); err == nil {
+		end = time.UnixMilli(before)
+	}
+
+	rpo := &RecentlyPlayedObject{Limit: limit}
+	for i := 1; i <= limit; i++ {
+		rpo.Items = append(rpo.Items, PlayHistoryObject{
+			Track:    *fakeTrack().Item,
+			PlayedAt: end.Add(-time.Duration(i) * 5 * time.Minute).UTC().Format(time.RFC3339),
+		})
+	}
+
+	last := end.Add(-time.Duration(limit) * 5 * time.Minute)
+	rpo.Cursors = &CursorObject{
+		Before: strconv.FormatInt(last.UnixMilli(), 10),
+		After:  strconv.FormatInt(end.UnixMilli(), 10),
+	}
+
+	f.writeJSON(w, r, rpo)
+}
+
+// metadata returns the playlist or album that the fake track is played
+// from, everything else is reported as missing.
+func (f *fakeSpotify) metadata(w http.ResponseWriter, r *http.Request) {
+	if f.authenticate(r) == "" {
+		f.writeError(w, http.StatusUnauthorized, "The access token expired")
+		return
+	}
+
+	track := fakeTrack()
+	var m *ContextMetadataObject
+	switch r.URL.Path {
+	case "/v1/playlists/37i9dQZF1DX5trt9i14X7j":
+		m = &ContextMetadataObject{
+			ExternalURLs: track.Context.ExternalURLs,
+			ID:           "37i9dQZF1DX5trt9i14X7j",
+			Images:       []ImageObject{{Height: 300, Width: 300, URL: "https://i.scdn.co/image/fake-playlist-300"}},
+			Name:         "Friday Focus",
+			Type:         "playlist",
+			Owner: &UserObject{
+				DisplayName: &f.user,
+				ID:          f.user,
+				Type:        "user",
+				URI:         "spotify:user:" + f.user,
+			},
+		}
+	case "/v1/albums/" + track.Item.Album.ID:
+		m = &ContextMetadataObject{
+			ExternalURLs: track.Item.Album.ExternalURLs,
+			ID:           track.Item.Album.ID,
+			Images:       track.Item.Album.Images,
+			Name:         track.Item.Album.Name,
+			Type:         "album",
+			Artists:      track.Item.Album.Artists,
+		}
+	default:
+		f.writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	f.writeJSON(w, r, m)
+}
+
+// writeJSON writes the given object as JSON. The images in the fixtures
+// point to Spotify's CDN, they're rewritten to point to the fake server so
+// that they can be fetched.
+func (f *fakeSpotify) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		f.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(strings.ReplaceAll(string(data), "https://i.scdn.co/image/", "http://"+r.Host+"/image/")))
+}
+
+// image returns a square PNG image in a color that is derived from the
+// name of the image. The size is taken from the end of the name, e.g.
+// fake-300, and defaults to 300 pixels.
+func (f *fakeSpotify) image(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/image/")
+
+	size := 300
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		if n, err := strconv.Atoi(name[i+1:]); err == nil && n > 0 && n <= 640 {
+			size = n
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	c := color.RGBA{R: uint8(sum), G: uint8(sum >> 8), B: uint8(sum >> 16), A: 255}
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: c}, image.Point{}, draw.Src)
+
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, img)
+}
+
+// writeError writes an error object in the same format as Spotify does.
+func (f *fakeSpotify) writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, newErrorAPI(status, message))
+}
+
+// fakePlaybackState adds the device, shuffle and repeat state to the
+// currently playing object if state is true.
+func fakePlaybackState(cpo *CurrentlyPlayingObject, state, private bool) *CurrentlyPlayingObject {
+	if !state {
+		return cpo
+	}
+
+	id := "fake-device"
+	volume := 40
+	shuffle := true
+	cpo.Device = &DeviceObject{
+		ID:               &id,
+		IsActive:         true,
+		IsPrivateSession: private,
+		Name:             "Kitchen speaker",
+		Type:             "Speaker",
+		VolumePercent:    &volume,
+	}
+	cpo.ShuffleState = &shuffle
+	cpo.RepeatState = "context"
+	return cpo
+}
+
+// fakeTrack returns a currently playing object with a track.
+func fakeTrack() *CurrentlyPlayingObject {
+	progress := 42000
+	return &CurrentlyPlayingObject{
+		Context: &ContextObject{
+			Type:         "playlist",
+			HREF:         "https://api.spotify.com/v1/playlists/37i9dQZF1DX5trt9i14X7j",
+			ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/playlist/37i9dQZF1DX5trt9i14X7j"},
+			URI:          "spotify:playlist:37i9dQZF1DX5trt9i14X7j",
+		},
+		ProgressMS:           &progress,
+		IsPlaying:            true,
+		CurrentlyPlayingType: "track",
+		Item: &TrackObjectFull{
+			Album: AlbumObjectSimplified{
+				AlbumType: "album",
+				Artists: []ArtistObjectSimplified{
+					{Name: "Kraftwerk", ID: "0dmPX6ovclgOy8WWJaFEUU", Type: "artist", URI: "spotify:artist:0dmPX6ovclgOy8WWJaFEUU"},
+				},
+				ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/album/1ZHpBQNzvRdTPDkbSg3Xpo"},
+				ID:           "1ZHpBQNzvRdTPDkbSg3Xpo",
+				Images: []ImageObject{
+					{Height: 640, Width: 640, URL: "https://i.scdn.co/image/fake-640"},
+					{Height: 300, Width: 300, URL: "https://i.scdn.co/image/fake-300"},
+					{Height: 64, Width: 64, URL: "https://i.scdn.co/image/fake-64"},
+				},
+				Name:        "Trans-Europe Express",
+				ReleaseDate: "1977-03-01",
+				Type:        "album",
+				URI:         "spotify:album:1ZHpBQNzvRdTPDkbSg3Xpo",
+			},
+			Artists: []ArtistObjectSimplified{
+				{Name: "Kraftwerk", ID: "0dmPX6ovclgOy8WWJaFEUU", Type: "artist", URI: "spotify:artist:0dmPX6ovclgOy8WWJaFEUU"},
+			},
+			DurationMS:   400000,
+			ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/track/6wHFd0WTpNZXjHLvVKkZCW"},
+			ID:           "6wHFd0WTpNZXjHLvVKkZCW",
+			Name:         "Europe Endless",
+			Type:         "track",
+			URI:          "spotify:track:6wHFd0WTpNZXjHLvVKkZCW",
+		},
+	}
+}
+
+// fakeEpisode returns a currently playing object with a podcast episode.
+func fakeEpisode() *CurrentlyPlayingObject {
+	progress := 600000
+	return &CurrentlyPlayingObject{
+		ProgressMS:           &progress,
+		IsPlaying:            true,
+		CurrentlyPlayingType: "episode",
+		Episode: &EpisodeObject{
+			Description:          "In which we finally find out what the question was.",
+			DurationMS:           3600000,
+			ExternalURLs:         map[string]string{"spotify": "https://open.spotify.com/episode/512ojhOuo1ktJprKbVcKyQ"},
+			ID:                   "512ojhOuo1ktJprKbVcKyQ",
+			Name:                 "Episode 42: The Answer",
+			ReleaseDate:          "2023-09-15",
+			ReleaseDatePrecision: "day",
+			Type:                 "episode",
+			URI:                  "spotify:episode:512ojhOuo1ktJprKbVcKyQ",
+			Show: ShowObject{
+				ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/show/38bS44xjbVVZ3No3ByF1dJ"},
+				Name:         "The Fake Podcast",
+				Images: []ImageObject{
+					{Height: 640, Width: 640, URL: "https://i.scdn.co/image/fake-show-640"},
+					{Height: 300, Width: 300, URL: "https://i.scdn.co/image/fake-show-300"},
+					{Height: 64, Width: 64, URL: "https://i.scdn.co/image/fake-show-64"},
+				},
+				ID:        "38bS44xjbVVZ3No3ByF1dJ",
+				Publisher: "Fake Media",
+				Type:      "show",
+				URI:       "spotify:show:38bS44xjbVVZ3No3ByF1dJ",
+			},
+		},
+	}
+}
+
+// fakeChapter returns a currently playing object with an audiobook
+// chapter, Spotify reports them as episodes.
+func fakeChapter() *CurrentlyPlayingObject {
+	progress := 120000
+	return &CurrentlyPlayingObject{
+		ProgressMS:           &progress,
+		IsPlaying:            true,
+		CurrentlyPlayingType: "episode",
+		Chapter: &ChapterObject{
+			Audiobook: AudiobookObject{
+				Authors:      []AuthorObject{{Name: "Douglas Adams"}},
+				ExternalURLs: map[string]string{"spotify": "https://open.spotify.com/show/7iHfbu1YPACw6oZPAFJtqe"},
+				ID:           "7iHfbu1YPACw6oZPAFJtqe",
+				Images: []ImageObject{
+					{Height: 300, Width: 300, URL: "https://i.scdn.co/image/fake-audiobook-300"},
+				},
+				Name: "The Hitchhiker's Guide to the Galaxy",
+				URI:  "spotify:show:7iHfbu1YPACw6oZPAFJtqe",
+			},
+			ChapterNumber: 1,
+			DurationMS:    1500000,
+			ExternalURLs:  map[string]string{"spotify": "https://open.spotify.com/episode/0D5wENdkdwbqlrHoaJ9g29"},
+			ID:            "0D5wENdkdwbqlrHoaJ9g29",
+			Name:          "Chapter 1",
+			Type:          "chapter",
+			URI:           "spotify:episode:0D5wENdkdwbqlrHoaJ9g29",
+		},
+	}
+}
+
+// fakeLocalTrack returns a currently playing object with a track from a
+// local file, which has no ID, album art or external URLs.
+func fakeLocalTrack() *CurrentlyPlayingObject {
+	progress := 30000
+	return &CurrentlyPlayingObject{
+		ProgressMS:           &progress,
+		IsPlaying:            true,
+		CurrentlyPlayingType: "track",
+		Item: &TrackObjectFull{
+			Album:      AlbumObjectSimplified{Name: "Demos", Type: "album"},
+			Artists:    []ArtistObjectSimplified{{Name: "Garage Band", Type: "artist"}},
+			DurationMS: 180000,
+			Name:       "Basement Tape",
+			Type:       "track",
+			URI:        "spotify:local:Garage+Band:Demos:Basement+Tape:180",
+			IsLocal:    true,
+		},
+	}
+}
+
+// fakeAd returns a currently playing object with an ad, which has no item.
+func fakeAd() *CurrentlyPlayingObject {
+	progress := 5000
+	return &CurrentlyPlayingObject{
+		ProgressMS:           &progress,
+		IsPlaying:            true,
+		CurrentlyPlayingType: "ad",
+	}
+}
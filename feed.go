@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of listens in the feeds.
+const feedSize = 50
+
+// atomFeed is an Atom feed, see RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Links     []atomLink `xml:"link"`
+	Summary   string     `xml:"summary"`
+}
+
+// rssFeed is an RSS 2.0 feed.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link,omitempty"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Enclosure   *rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// playTitle returns the title of a play, e.g. "Kraftwerk - Europe Endless".
+func playTitle(p *play) string {
+	if p.Artists == "" {
+		return p.Name
+	}
+	return p.Artists + " - " + p.Name
+}
+
+// playSummary describes a play, e.g. "alice listened to Europe Endless by
+// Kraftwerk from Trans-Europe Express". Episodes are from their show.
+func playSummary(p *play) string {
+	s := fmt.Sprintf("%s listened to %s", p.UserID, p.Name)
+	if p.ItemType == "episode" && p.Artists != "" {
+		return s + " from " + p.Artists
+	}
+	if p.Artists != "" {
+		s += " by " + p.Artists
+	}
+	if p.Album != "" {
+		s += " from " + p.Album
+	}
+	return s
+}
+
+// feedETag returns an ETag that changes whenever a listen is added. It's
+// computed from the listens so that it can be compared without rendering
+// the feed. The entries don't change once they're listens, so the progress
+// that is recorded on every poll doesn't change the ETag.
+func feedETag(format string, plays []*play) string {
+	h := sha256.New()
+	h.Write([]byte(format))
+	for _, p := range plays {
+		fmt.Fprintf(h, "\n%d %d %d", p.ID, p.StartedAt.UnixNano(), p.ListenedAt.UnixNano())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// feedLastModified returns when the most recent listen became a listen, the
+// zero time is returned if there are no listens.
+func feedLastModified(plays []*play) time.Time {
+	var t time.Time
+	for _, p := range plays {
+		if p.ListenedAt.After(t) {
+			t = p.ListenedAt
+		}
+	}
+	return t.UTC().Truncate(time.Second)
+}
+
+// notModified checks the conditional headers of the request, If-None-Match
+// takes precedence over If-Modified-Since. If-None-Match may list several
+// ETags and they're compared with the weak comparison, see RFC 9110.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := strings.Join(r.Header.Values("If-None-Match"), ","); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !lastModified.After(t)
+		}
+	}
+	return false
+}
+
+// feed renders the listening history of the given user id as an Atom or
+// RSS feed, format is either "atom" or "rss".
+func (a *app) feed(w http.ResponseWriter, r *http.Request, id, format string) {
+	if a.getToken(id) == nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s has not authorized lyssnar.com yet\n", id)
+		return
+	}
+
+	plays, err := a.getListens(id, feedSize)
+	if err != nil {
+		log.Printf("can't get listens for %s: %v", id, err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "An error occured, try again later.")
+		return
+	}
+
+	etag := feedETag(format, plays)
+	lastModified := feedLastModified(plays)
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// An empty feed has never been updated, the time the user authorized
+	// isn't known so the current time is used instead.
+	updated := lastModified
+	if updated.IsZero() {
+		updated = time.Now().UTC().Truncate(time.Second)
+	}
+
+	var v interface{}
+	if format == "atom" {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		v = a.atomFeed(id, plays, updated)
+	} else {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		v = a.rssFeed(id, plays, updated)
+	}
+
+	x, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("can't marshal %s feed for %s: %v", format, id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, xml.Header+string(x)+"\n")
+}
+
+// atomFeed returns the listens as an Atom feed.
+func (a *app) atomFeed(id string, plays []*play, updated time.Time) *atomFeed {
+	pageURL := a.userURL(id)
+	f := &atomFeed{
+		Title:   fmt.Sprintf("%s on lyssnar", id),
+		ID:      pageURL + "/feed.atom",
+		Updated: updated.Format(time.RFC3339),
+		Author:  atomPerson{Name: id, URI: pageURL},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: pageURL + "/feed.atom"},
+			{Rel: "alternate", Type: "text/html", Href: pageURL},
+		},
+	}
+
+	for _, p := range plays {
+		e := atomEntry{
+			Title:     playTitle(p),
+			ID:        pageURL + "/plays/" + strconv.FormatInt(p.ID, 10),
+			Published: p.StartedAt.UTC().Format(time.RFC3339),
+			Updated:   p.ListenedAt.UTC().Format(time.RFC3339),
+			Summary:   playSummary(p),
+		}
+		if p.URL != "" {
+			e.Links = append(e.Links, atomLink{Rel: "alternate", Type: "text/html", Href: p.URL})
+		}
+		if p.ImageURL != "" {
+			e.Links = append(e.Links, atomLink{Rel: "enclosure", Type: "image/jpeg", Href: p.ImageURL})
+		}
+		f.Entries = append(f.Entries, e)
+	}
+	return f
+}
+
+// rssFeed returns the listens as an RSS feed.
+func (a *app) rssFeed(id string, plays []*play, updated time.Time) *rssFeed {
+	pageURL := a.userURL(id)
+	f := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         fmt.Sprintf("%s on lyssnar", id),
+			Link:          pageURL,
+			Description:   fmt.Sprintf("What %s has listened to on Spotify", id),
+			LastBuildDate: updated.Format(time.RFC1123Z),
+		},
+	}
+
+	for _, p := range plays {
+		i := rssItem{
+			Title:       playTitle(p),
+			Link:        p.URL,
+			GUID:        rssGUID{Value: pageURL + "/plays/" + strconv.FormatInt(p.ID, 10)},
+			PubDate:     p.StartedAt.UTC().Format(time.RFC1123Z),
+			Description: playSummary(p),
+		}
+		if p.ImageURL != "" {
+			i.Enclosure = &rssEnclosure{URL: p.ImageURL, Type: "image/jpeg"}
+		}
+		f.Channel.Items = append(f.Channel.Items, i)
+	}
+	return f
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	etag := `"abc"`
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"none", http.Header{}, false},
+		{"match", http.Header{"If-None-Match": {`"abc"`}}, true},
+		{"weak", http.Header{"If-None-Match": {`W/"abc"`}}, true},
+		{"list", http.Header{"If-None-Match": {`"x", "abc"`}}, true},
+		{"several headers", http.Header{"If-None-Match": {`"x"`, `"abc"`}}, true},
+		{"star", http.Header{"If-None-Match": {"*"}}, true},
+		{"mismatch", http.Header{"If-None-Match": {`"x"`}}, false},
+		{"since", http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, true},
+		{"since later", http.Header{"If-Modified-Since": {lastModified.Add(time.Hour).Format(http.TimeFormat)}}, true},
+		{"since earlier", http.Header{"If-Modified-Since": {lastModified.Add(-time.Second).Format(http.TimeFormat)}}, false},
+		{"since invalid", http.Header{"If-Modified-Since": {"yesterday"}}, false},
+
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"mismatch and since", http.Header{"If-None-Match": {`"x"`}, "If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/~alice/feed.atom", nil)
+		r.Header = tt.header
+		if got := notModified(r, etag, lastModified); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFeedNotModified(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+
+	started := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	p := &play{UserID: "alice", ItemID: "1", ItemType: "track", Name: "First", DurationMS: 200000, ProgressMS: 150000, Listened: true, ListenedAt: started.Add(2 * time.Minute), StartedAt: started, UpdatedAt: started.Add(2 * time.Minute)}
+	if err := a.insertPlay(p); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/~alice/feed.atom", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		return serve(a, r)
+	}
+
+	w := get(nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("got ETag %q and Last-Modified %q", etag, lastModified)
+	}
+
+	// Recording progress doesn't change the feed.
+	p.ProgressMS = 190000
+	p.UpdatedAt = time.Now()
+	if err := a.updatePlay(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-None-Match": {"W/" + etag}},
+		{"If-None-Match": {`"other", ` + etag}},
+		{"If-Modified-Since": {lastModified}},
+	} {
+		if w := get(h); w.Code != http.StatusNotModified {
+			t.Errorf("%v: got status %d, want %d", h, w.Code, http.StatusNotModified)
+		}
+	}
+
+	// A new listen changes the feed.
+	n := &play{UserID: "alice", ItemID: "2", ItemType: "track", Name: "Second", DurationMS: 200000, ProgressMS: 150000, Listened: true, ListenedAt: time.Now(), StartedAt: time.Now().Add(-2 * time.Minute), UpdatedAt: time.Now()}
+	if err := a.insertPlay(n); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK {
+		t.Errorf("got status %d after a new listen, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestFeedFormats(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+
+	started := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for _, p := range []*play{
+		{UserID: "alice", ItemID: "1", ItemType: "track", Name: "Listened", Artists: "Kraftwerk", DurationMS: 200000, ProgressMS: 150000, Listened: true, ListenedAt: started.Add(2 * time.Minute), StartedAt: started, UpdatedAt: started.Add(2 * time.Minute)},
+		{UserID: "alice", ItemID: "2", ItemType: "track", Name: "Skipped", Artists: "Kraftwerk", DurationMS: 200000, ProgressMS: 10000, StartedAt: started.Add(5 * time.Minute), UpdatedAt: started.Add(5 * time.Minute)},
+	} {
+		if err := a.insertPlay(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice/feed.atom", nil))
+	atom := &atomFeed{}
+	if err := xml.Unmarshal(w.Body.Bytes(), atom); err != nil {
+		t.Fatalf("invalid atom feed: %v\n%s", err, w.Body)
+	}
+	if len(atom.Entries) != 1 || !strings.Contains(atom.Entries[0].Title, "Listened") {
+		t.Errorf("got atom entries %+v, want only the listen", atom.Entries)
+	}
+
+	w = serve(a, httptest.NewRequest(http.MethodGet, "/~alice/feed.rss", nil))
+	rss := &rssFeed{}
+	if err := xml.Unmarshal(w.Body.Bytes(), rss); err != nil {
+		t.Fatalf("invalid rss feed: %v\n%s", err, w.Body)
+	}
+	if rss.Version != "2.0" || len(rss.Channel.Items) != 1 || !strings.Contains(rss.Channel.Items[0].Title, "Listened") {
+		t.Errorf("got rss version %q and items %+v, want only the listen", rss.Version, rss.Channel.Items)
+	}
+
+	if w := serve(a, httptest.NewRequest(http.MethodGet, "/~bob/feed.atom", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for bob, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Limits that keep the user defined short formats cheap to run.
+const (
+	maxShortFormatLength = 512
+	maxShortFormatOutput = 1024
+)
+
+// shortFormatFuncs are the functions that can be used in a short format in
+// addition to the comparison and logic functions. The built in functions
+// that can be used to produce large outputs or call functions are replaced
+// so that they can't be used even if they slip through the validation.
+var shortFormatFuncs = template.FuncMap{
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"call":    disabledShortFormatFunc,
+	"print":   disabledShortFormatFunc,
+	"printf":  disabledShortFormatFunc,
+	"println": disabledShortFormatFunc,
+}
+
+// allowedShortFormatIdentifiers are the functions that a short format is
+// allowed to call.
+var allowedShortFormatIdentifiers = map[string]bool{
+	"and": true, "or": true, "not": true,
+	"eq": true, "ne": true, "lt": true, "le": true, "gt": true, "ge": true,
+	"len": true, "urlquery": true, "upper": true, "lower": true,
+}
+
+// errShortFormatFunc is returned by the functions that are disabled.
+var errShortFormatFunc = errors.New("function is not allowed")
+
+// disabledShortFormatFunc replaces the built in functions that aren't
+// allowed in short formats.
+func disabledShortFormatFunc(...interface{}) (string, error) {
+	return "", errShortFormatFunc
+}
+
+// shortFormatData contains the fields that can be used in a short format.
+// All fields are plain values, so a format can't call any methods.
+type shortFormatData struct {
+	User      string
+	Kind      string
+	Title     string
+	Artists   string
+	Album     string
+	Show      string
+	URL       string
+	URI       string
+	Device    string
+	Context   string
+	Progress  string
+	Duration  string
+	Remaining string
+	IsPlaying bool
+	Stale     bool
+}
+
+// newShortFormatData returns the short format fields for the currently
+// playing object that was fetched at the given time.
+func newShortFormatData(id string, cpo *CurrentlyPlayingObject, pc *playingContext, stale bool, fetchedAt, now time.Time) *shortFormatData {
+	d := &shortFormatData{
+		User:      id,
+		Kind:      cpo.CurrentlyPlayingType,
+		Device:    deviceName(cpo.Device),
+		IsPlaying: cpo.IsPlaying,
+		Stale:     stale,
+	}
+	if pc != nil {
+		d.Context = pc.String()
+	}
+
+	item := newPlayingItem(cpo)
+	if item == nil {
+		d.Title = undescribedItemText(cpo)
+		return d
+	}
+
+	progress := currentProgress(cpo, item.DurationMS, fetchedAt, now)
+	d.Kind = item.Type
+	d.Title = item.Name
+	d.URL = item.URL
+	d.URI = item.URI
+	d.Progress = formatPosition(progress)
+	d.Duration = formatPosition(item.DurationMS)
+	d.Remaining = formatRemaining(item.DurationMS - progress)
+	if item.Type == "episode" {
+		d.Show = item.Artists
+	} else {
+		d.Artists = item.Artists
+		d.Album = item.Album
+	}
+	return d
+}
+
+// parseShortFormat parses and validates a user defined short format. Only
+// field lookups, if/else, with, variables, literals and a small set of
+// functions are allowed, there are no loops, no nested templates and no
+// formatting functions that can produce arbitrarily large outputs.
+func parseShortFormat(format string) (*template.Template, error) {
+	if len(format) > maxShortFormatLength {
+		return nil, fmt.Errorf("format can't be longer than %d bytes", maxShortFormatLength)
+	}
+
+	t, err := template.New("format").Funcs(shortFormatFuncs).Parse(format)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Templates()) > 1 {
+		return nil, errors.New("format can't define templates")
+	}
+	if t.Tree == nil {
+		return t, nil
+	}
+
+	if err := validateShortFormatNode(t.Tree.Root); err != nil {
+		return nil, err
+	}
+
+	// Run the format once so that references to fields that don't exist
+	// are caught before it's used.
+	if _, err := executeShortFormat(t, &shortFormatData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validateShortFormatNode walks the parse tree and returns an error if it
+// contains anything that isn't allowed.
+func validateShortFormatNode(n parse.Node) error {
+	switch n := n.(type) {
+	case nil:
+		return nil
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			if err := validateShortFormatNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.TextNode, *parse.CommentNode, *parse.FieldNode, *parse.VariableNode,
+		*parse.DotNode, *parse.StringNode, *parse.NumberNode, *parse.BoolNode, *parse.NilNode:
+		return nil
+	case *parse.ActionNode:
+		return validateShortFormatNode(n.Pipe)
+	case *parse.IfNode:
+		return validateShortFormatBranch(&n.BranchNode)
+	case *parse.WithNode:
+		return validateShortFormatBranch(&n.BranchNode)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			if err := validateShortFormatNode(c); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if err := validateShortFormatNode(a); err != nil {
+				return err
+			}
+		}
+	case *parse.ChainNode:
+		return validateShortFormatNode(n.Node)
+	case *parse.IdentifierNode:
+		if !allowedShortFormatIdentifiers[n.Ident] {
+			return fmt.Errorf("function %q is not allowed", n.Ident)
+		}
+	default:
+		return fmt.Errorf("%q is not allowed", n.String())
+	}
+	return nil
+}
+
+// validateShortFormatBranch validates the pipeline and both lists of an if
+// or with node.
+func validateShortFormatBranch(n *parse.BranchNode) error {
+	if err := validateShortFormatNode(n.Pipe); err != nil {
+		return err
+	}
+	if err := validateShortFormatNode(n.List); err != nil {
+		return err
+	}
+	return validateShortFormatNode(n.ElseList)
+}
+
+// limitedBuffer is a buffer that returns an error when it's full.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		return 0, fmt.Errorf("output can't be longer than %d bytes", b.limit)
+	}
+	return b.Buffer.Write(p)
+}
+
+// executeShortFormat runs the short format with the given data.
+func executeShortFormat(t *template.Template, d *shortFormatData) (string, error) {
+	b := &limitedBuffer{limit: maxShortFormatOutput}
+	if err := t.Execute(b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
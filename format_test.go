@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseShortFormat(t *testing.T) {
+	valid := []string{
+		"",
+		"plain text",
+		"{{.Title}} by {{.Artists}}",
+		"{{if .IsPlaying}}▶{{else}}⏸{{end}} {{.Title}}",
+		"{{with .Album}}from {{.}}{{end}}",
+		"{{$t := .Title}}{{upper $t}}",
+		`{{if and (eq .Kind "episode") (gt (len .Show) 0)}}{{.Show}}{{end}}`,
+		"{{.Title | lower | urlquery}}",
+		"{{/* a comment */}}{{.Progress}}/{{.Duration}}",
+	}
+	for _, f := range valid {
+		if _, err := parseShortFormat(f); err != nil {
+			t.Errorf("parseShortFormat(%q) returned %v", f, err)
+		}
+	}
+
+	invalid := []string{
+		"{{.Title",
+		"{{.Missing}}",
+		"{{call .Title}}",
+		`{{print "x"}}`,
+		`{{printf "%0999999d" 1}}`,
+		`{{println "x"}}`,
+		"{{range .Artists}}x{{end}}",
+		`{{define "x"}}y{{end}}`,
+		`{{template "format"}}`,
+		"{{block \"x\" .}}y{{end}}",
+		"{{html .Title}}",
+		"{{js .Title}}",
+		"{{index .Title 0}}",
+		"{{slice .Title 1}}",
+		"{{if .IsPlaying}}{{call .Title}}{{end}}",
+		"{{with .Title}}{{else}}{{print .}}{{end}}",
+		"{{break}}",
+		strings.Repeat("x", maxShortFormatLength+1),
+	}
+	for _, f := range invalid {
+		if _, err := parseShortFormat(f); err == nil {
+			t.Errorf("parseShortFormat(%q) was accepted", f)
+		}
+	}
+}
+
+func TestExecuteShortFormatLimit(t *testing.T) {
+	tmpl, err := parseShortFormat("{{.Title}}{{.Title}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeShortFormat(tmpl, &shortFormatData{Title: strings.Repeat("x", maxShortFormatOutput)}); err == nil {
+		t.Error("output longer than the limit was accepted")
+	}
+}
+
+func TestShortAPIFormat(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	cacheTestObject(a, percentTrack())
+
+	path := "/v1/user/alice/currently-playing-short?format=" + url.QueryEscape("{{.Title}} (100%)")
+	w := serve(a, httptest.NewRequest(http.MethodGet, path, nil))
+	var v struct {
+		Playing string `json:"playing"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body, err)
+	}
+	if want := "100% Pure Love (100%)"; v.Playing != want {
+		t.Errorf("got %q, want %q", v.Playing, want)
+	}
+
+	w = serve(a, httptest.NewRequest(http.MethodGet, path+"&plain=1", nil))
+	if want := "100% Pure Love (100%)\n"; w.Body.String() != want {
+		t.Errorf("got %q, want %q", w.Body, want)
+	}
+}
@@ -4,13 +4,15 @@ go 1.19
 
 require (
 	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/osm/migrator v1.1.1
+	golang.org/x/image v0.14.0
 	golang.org/x/oauth2 v0.15.0
+	golang.org/x/text v0.14.0
 )
 
 require (
 	github.com/golang/protobuf v1.5.3 // indirect
-	golang.org/x/net v0.19.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.32.0 // indirect
 )
@@ -0,0 +1,137 @@
+package main
+
+import "strings"
+
+// playingItem describes a track, an episode or an audiobook chapter in the
+// same way regardless of its type, it's what the pages and the APIs
+// render.
+type playingItem struct {
+	// The type of the item, "track", "episode" or "chapter".
+	Type string
+
+	// The Spotify ID of the item, empty for local files.
+	ID string
+
+	// The Spotify URI of the item.
+	URI string
+
+	// The name of the track, episode or chapter.
+	Name string
+
+	// Comma separated list of artists, the name of the show for episodes
+	// or the authors of the audiobook for chapters.
+	Artists string
+
+	// The same as Artists, as a list.
+	ArtistList []string
+
+	// The name of the album or the audiobook, empty for episodes.
+	Album string
+
+	// The URL to the item on Spotify, empty for local files.
+	URL string
+
+	// The URL to the album, show or audiobook art, empty for local files.
+	Image string
+
+	// The album, show or audiobook art in all sizes, widest first.
+	Images []ImageObject
+
+	// The length of the item in milliseconds.
+	DurationMS int
+
+	// Whether or not the item is a local file.
+	IsLocal bool
+}
+
+// newPlayingItem returns the item of the currently playing object, nil is
+// returned if nothing is playing or if the item can't be described, which
+// is the case for ads and unknown items.
+func newPlayingItem(cpo *CurrentlyPlayingObject) *playingItem {
+	var i *playingItem
+	switch {
+	case cpo == nil:
+		return nil
+	case cpo.Item != nil:
+		t := cpo.Item
+		i = &playingItem{
+			Type:       "track",
+			ID:         t.ID,
+			URI:        t.URI,
+			Name:       t.Name,
+			ArtistList: artistList(t.Artists),
+			Album:      t.Album.Name,
+			URL:        t.ExternalURLs["spotify"],
+			Images:     t.Album.Images,
+			DurationMS: t.DurationMS,
+			IsLocal:    t.IsLocal,
+		}
+	case cpo.Episode != nil:
+		e := cpo.Episode
+		i = &playingItem{
+			Type:       "episode",
+			ID:         e.ID,
+			URI:        e.URI,
+			Name:       e.Name,
+			ArtistList: []string{e.Show.Name},
+			URL:        e.ExternalURLs["spotify"],
+			Images:     e.Images,
+			DurationMS: e.DurationMS,
+		}
+		if i.URL == "" {
+			i.URL = e.Show.ExternalURLs["spotify"]
+		}
+		if len(i.Images) == 0 {
+			i.Images = e.Show.Images
+		}
+	case cpo.Chapter != nil:
+		c := cpo.Chapter
+		i = &playingItem{
+			Type:       "chapter",
+			ID:         c.ID,
+			URI:        c.URI,
+			Name:       c.Name,
+			ArtistList: authorList(c.Audiobook.Authors),
+			Album:      c.Audiobook.Name,
+			URL:        c.ExternalURLs["spotify"],
+			Images:     c.Images,
+			DurationMS: c.DurationMS,
+		}
+		if len(i.Images) == 0 {
+			i.Images = c.Audiobook.Images
+		}
+	default:
+		return nil
+	}
+
+	i.Artists = strings.Join(i.ArtistList, ", ")
+	i.Image = imageURL(i.Images)
+	return i
+}
+
+// undescribedItemText returns what to show instead of the item when the
+// currently playing object doesn't have one that can be described.
+func undescribedItemText(cpo *CurrentlyPlayingObject) string {
+	if cpo.CurrentlyPlayingType == "ad" {
+		return "an advertisement"
+	}
+	return "something that can't be shown"
+}
+
+// artistList returns the names of the artists.
+func artistList(artists []ArtistObjectSimplified) []string {
+	var names []string
+	for _, a := range artists {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// authorList returns the names of the authors.
+func authorList(authors []AuthorObject) []string {
+	var names []string
+	for _, a := range authors {
+		names = append(names, a.Name)
+	}
+	return names
+}
@@ -5,17 +5,37 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/spotify"
 )
 
 // app contains the internal data structure used by the application.
 type app struct {
-	db    *sql.DB
-	dbURL string
-	conf  *oauth2.Config
-	port  string
+	db      *sql.DB
+	dbURL   string
+	storage storage
+	conf    *oauth2.Config
+	apiURL  string
+	baseURL string
+	port    string
+
+	sessionKey    []byte
+	keys          *keyring
+	tokenLocks    userLocks
+	playLocks     userLocks
+	lastKnownKeys lastKnownKeys
+	stream        *streamHub
+	cache         *playingCache
+	recent        *recentlyPlayedCache
+	contexts      *ttlCache[string, *playingContext]
+	art           *artCache
+	pngs          *ttlCache[string, []byte]
+	httpClient    *http.Client
+
+	pollInterval time.Duration
 }
 
 // getEnv looks for the given key in the environment and logs a fatal
@@ -28,32 +48,150 @@ func getEnv(key string) string {
 	return val
 }
 
+// getEnvDefault looks for the given key in the environment and returns
+// the default value if the key can't be found or is empty.
+func getEnvDefault(key, def string) string {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	return val
+}
+
+// getEnvDuration looks for the given key in the environment and parses it
+// as a duration, the default value is returned if the key can't be found.
+// A fatal error is logged if the value can't be parsed.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("$%s must be a valid duration, %v", key, err)
+	}
+	return d
+}
+
+// getEnvFloat looks for the given key in the environment and parses it as
+// a positive number, the default value is returned if the key can't be
+// found. A fatal error is logged if the value can't be parsed.
+func getEnvFloat(key string, def float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f <= 0 {
+		log.Fatalf("$%s must be a positive number", key)
+	}
+	return f
+}
+
+// getKeyring parses the encryption keys from the environment and logs a
+// fatal error if they're invalid.
+func getKeyring() *keyring {
+	keys, err := parseKeyring(os.Getenv("LYSSNAR_ENCRYPTION_KEY"), os.Getenv("LYSSNAR_OLD_ENCRYPTION_KEYS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+// rotateKeysMain is the entry point of the rotate-keys command, it
+// re-encrypts all stored tokens with the primary encryption key.
+func rotateKeysMain() {
+	a := &app{
+		dbURL: getEnv("DATABASE_URL"),
+		keys:  getKeyring(),
+	}
+	if a.keys == nil {
+		log.Fatal("$LYSSNAR_ENCRYPTION_KEY must be set")
+	}
+
+	if err := a.initDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	n, err := a.rotateKeys()
+	if err != nil {
+		log.Fatalf("rotated %d credentials before failing: %v", n, err)
+	}
+	log.Printf("rotated %d credentials to key %s", n, a.keys.primary)
+}
+
 // main is the entry point of the application.
 func main() {
+	// Run the requested command, if any.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fake-spotify":
+			fakeSpotifyMain(os.Args[2:])
+		case "rotate-keys":
+			rotateKeysMain()
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
 	port := getEnv("PORT")
 	spotifyCallback := getEnv("SPOTIFY_CALLBACK")
+	baseURL := getEnvDefault("BASE_URL", strings.TrimSuffix(spotifyCallback, "/callback"))
 	spotifyClientID := getEnv("SPOTIFY_CLIENT_ID")
 	spotifyClientSecret := getEnv("SPOTIFY_CLIENT_SECRET")
+	spotifyAPIURL := getEnvDefault("SPOTIFY_API_URL", "https://api.spotify.com")
+	spotifyAccountsURL := getEnvDefault("SPOTIFY_ACCOUNTS_URL", "https://accounts.spotify.com")
 	dbURL := getEnv("DATABASE_URL")
+	sessionKey := getEnvDefault("LYSSNAR_SESSION_KEY", "")
+	keys := getKeyring()
+	pollInterval := getEnvDuration("POLL_INTERVAL", 30*time.Second)
+	streamInterval := getEnvDuration("STREAM_POLL_INTERVAL", 5*time.Second)
+	cacheTTL := getEnvDuration("CACHE_TTL", 5*time.Second)
+	recentlyPlayedCacheTTL := getEnvDuration("RECENTLY_PLAYED_CACHE_TTL", 30*time.Second)
+	spotifyRateLimit := getEnvFloat("SPOTIFY_RATE_LIMIT", 10)
 
 	a := &app{
 		conf: &oauth2.Config{
 			RedirectURL:  spotifyCallback,
 			ClientID:     spotifyClientID,
 			ClientSecret: spotifyClientSecret,
-			Scopes: []string{
-				"user-read-currently-playing",
+			Scopes:       scopes(),
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  spotifyAccountsURL + "/authorize",
+				TokenURL: spotifyAccountsURL + "/api/token",
 			},
-			Endpoint: spotify.Endpoint,
 		},
-		dbURL: dbURL,
-		port:  port,
+		apiURL:       spotifyAPIURL,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		dbURL:        dbURL,
+		port:         port,
+		pollInterval: pollInterval,
+		sessionKey:   newSessionKey(sessionKey),
+		keys:         keys,
+		cache:        newPlayingCache(cacheTTL),
+		recent:       newRecentlyPlayedCache(recentlyPlayedCacheTTL),
+		contexts:     newMetadataCache(),
+		art:          newArtCache(),
+		pngs:         newPNGCache(),
+		httpClient: &http.Client{
+			Transport: newScheduler(spotifyRateLimit),
+			Timeout:   10 * time.Second,
+		},
 	}
 
+	a.stream = newStreamHub(a, streamInterval)
+
 	if err := a.initDB(); err != nil {
 		log.Fatal(err)
 	}
 
+	// Start recording the listening history of all users in the
+	// background.
+	go a.poll(a.pollInterval)
+
 	http.HandleFunc("/", a.route)
 	http.ListenAndServe(":"+a.port, nil)
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
+)
+
+// Representations of the user's page.
+const (
+	representationHTML = "text/html"
+	representationJSON = "application/json"
+	representationText = "text/plain"
+	representationANSI = "ansi"
+)
+
+// Width of the progress bar in the text representations.
+const textProgressWidth = 30
+
+// ANSI escape codes used in the terminal representation.
+const (
+	ansiReset = "\033[0m"
+	ansiBold  = "\033[1m"
+	ansiDim   = "\033[2m"
+	ansiGreen = "\033[32m"
+	ansiCyan  = "\033[36m"
+)
+
+// negotiate picks the representation of the user's page from the Accept
+// header, HTML is picked if there's no preference. Terminal clients such as
+// curl and wget get a colored box unless they ask for something specific.
+func negotiate(r *http.Request) string {
+	accept := strings.TrimSpace(r.Header.Get("Accept"))
+	if accept == "" || accept == "*/*" {
+		ua := strings.ToLower(r.UserAgent())
+		if strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") {
+			return representationANSI
+		}
+	}
+
+	best, bestQ := representationHTML, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, p := range params[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "q" {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		// The representations are listed in the order they are preferred
+		// when they're equally acceptable.
+		for _, rep := range []string{representationHTML, representationJSON, representationText} {
+			typ, _, _ := strings.Cut(rep, "/")
+			if (mediaType == rep || mediaType == typ+"/*" || mediaType == "*/*") && q > bestQ {
+				best, bestQ = rep, q
+			}
+		}
+	}
+
+	return best
+}
+
+// currentlyPlayingNegotiated renders the user's page in the representation
+// that the client asks for.
+func (a *app) currentlyPlayingNegotiated(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Add("Vary", "Accept, User-Agent")
+
+	switch rep := negotiate(r); rep {
+	case representationJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		a.nowPlayingAPI(w, r, id)
+	case representationText, representationANSI:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		a.currentlyPlayingText(w, r, id, rep == representationANSI)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		a.currentlyPlaying(w, r, id)
+	}
+}
+
+// currentlyPlayingText renders what the given user id is playing as plain
+// text, or as a box with ANSI colors if ansi is true.
+func (a *app) currentlyPlayingText(w http.ResponseWriter, r *http.Request, id string, ansi bool) {
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	if err == errNotAuthorized {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "%s has not authorized lyssnar.com yet\n", id)
+		return
+	}
+
+	if writeUnavailable(w, err) {
+		fmt.Fprintln(w, "Spotify is temporarily unavailable, try again in a little while.")
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "An error occured, try again later.")
+		return
+	}
+
+	// Each line is a text and the ANSI codes to color it with. The texts
+	// come from Spotify and may contain escape codes of their own, which
+	// could take over the visitor's terminal, so control characters are
+	// stripped from them.
+	var lines [][2]string
+	add := func(color, text string) {
+		lines = append(lines, [2]string{color, stripControl(text)})
+	}
+
+	if cpo == nil {
+		add(ansiBold, fmt.Sprintf("%s is not using Spotify right now", id))
+		p, err := a.getLastPlay(id)
+		if err != nil {
+			log.Printf("can't get last play for %s: %v", id, err)
+		}
+		if p != nil {
+			add(ansiDim, fmt.Sprintf("Last listened to %s - %s, %s", p.Artists, p.Name, timeAgo(time.Since(p.UpdatedAt))))
+		}
+	} else {
+		n := newNowPlayingAPI(cpo, fetchedAt, time.Now(), stale != nil)
+
+		verb := "is listening to"
+		if stale != nil {
+			verb = "was listening to, " + timeAgo(stale.age())
+		} else if !n.IsPlaying {
+			verb = "has paused"
+		}
+		add(ansiDim, fmt.Sprintf("%s %s", id, verb))
+
+		if n.Title == "" {
+			add(ansiBold+ansiGreen, undescribedItemText(cpo))
+		} else {
+			add(ansiBold+ansiGreen, n.Title)
+			switch {
+			case n.Show != "":
+				add(ansiCyan, n.Show)
+			case n.Album != "":
+				add(ansiCyan, strings.Join(n.Artists, ", ")+" - "+n.Album)
+			default:
+				add(ansiCyan, strings.Join(n.Artists, ", "))
+			}
+		}
+
+		// The progress bar is added as is since it has escape codes
+		// of its own.
+		if n.DurationMS > 0 {
+			lines = append(lines, [2]string{"", fmt.Sprintf("%s %s / %s", progressBar(n.ProgressMS, n.DurationMS, ansi), formatPosition(n.ProgressMS), formatPosition(n.DurationMS))})
+		}
+		if n.URL != "" {
+			add(ansiDim, n.URL)
+		}
+	}
+
+	if !ansi {
+		for _, l := range lines {
+			fmt.Fprintln(w, l[1])
+		}
+		return
+	}
+
+	// Draw a box around the lines, the width is the number of columns
+	// the text takes up in the terminal, not counting the escape codes.
+	width := 0
+	for _, l := range lines {
+		if n := visibleLength(l[1]); n > width {
+			width = n
+		}
+	}
+
+	fmt.Fprintf(w, "╭%s╮\n", strings.Repeat("─", width+2))
+	for _, l := range lines {
+		pad := strings.Repeat(" ", width-visibleLength(l[1]))
+		if l[0] == "" {
+			fmt.Fprintf(w, "│ %s%s │\n", l[1], pad)
+		} else {
+			fmt.Fprintf(w, "│ %s%s%s%s │\n", l[0], l[1], ansiReset, pad)
+		}
+	}
+	fmt.Fprintf(w, "╰%s╯\n", strings.Repeat("─", width+2))
+}
+
+// progressBar draws a progress bar, the filled part is colored if ansi is
+// true.
+func progressBar(progressMS, durationMS int, ansi bool) string {
+	filled := progressMS * textProgressWidth / durationMS
+	if ansi {
+		return ansiGreen + strings.Repeat("━", filled) + ansiReset + ansiDim + strings.Repeat("━", textProgressWidth-filled) + ansiReset
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", textProgressWidth-filled) + "]"
+}
+
+// visibleLength returns the number of columns the text takes up in a
+// terminal, not counting ANSI escape codes.
+func visibleLength(s string) int {
+	n := 0
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			if j := strings.IndexByte(s[i:], 'm'); j >= 0 {
+				i += j + 1
+				continue
+			}
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// runeWidth returns the number of columns the rune takes up in a terminal.
+// Wide characters, such as CJK characters and most emoji, take up two
+// columns and combining marks and other zero width characters none.
+func runeWidth(r rune) int {
+	if unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// stripControl removes the C0 and C1 control characters from the text, such
+// as the escape character that starts ANSI escape codes. Tabs and line
+// breaks are replaced with spaces.
+func stripControl(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept, ua string
+		want       string
+	}{
+		{"", "", representationHTML},
+		{"*/*", "Mozilla/5.0", representationHTML},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "Mozilla/5.0", representationHTML},
+		{"application/json", "", representationJSON},
+		{"text/plain", "", representationText},
+		{"text/*", "", representationHTML},
+		{"text/html;q=0.5, application/json", "", representationJSON},
+		{"application/json;q=0.2, text/plain;q=0.9", "", representationText},
+		{"TEXT/PLAIN", "", representationText},
+		{"image/png", "", representationHTML},
+		{"", "curl/8.4.0", representationANSI},
+		{"*/*", "Wget/1.21", representationANSI},
+		{"application/json", "curl/8.4.0", representationJSON},
+		{"text/plain", "curl/8.4.0", representationText},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/~alice", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		r.Header.Set("User-Agent", tt.ua)
+
+		if got := negotiate(r); got != tt.want {
+			t.Errorf("negotiate(%q, %q) = %q, want %q", tt.accept, tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestStripControl(t *testing.T) {
+	tests := map[string]string{
+		"plain":                 "plain",
+		"a\tb\nc\rd":            "a b c d",
+		"\033[2J\033]0;x\007ok": "[2J]0;xok",
+		"\u009b31mred":          "31mred",
+		"åäö 日本":                "åäö 日本",
+	}
+
+	for in, want := range tests {
+		if got := stripControl(in); got != want {
+			t.Errorf("stripControl(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestVisibleLength(t *testing.T) {
+	tests := map[string]int{
+		"":                                  0,
+		"abc":                               3,
+		"åäö":                               3,
+		"e\u0301":                           1,
+		"日本":                                4,
+		"\uff58":                            2,
+		"a\u200bb":                          2,
+		ansiBold + "abc" + ansiReset:        3,
+		progressBar(500, 1000, true):        textProgressWidth,
+		progressBar(500, 1000, false):       textProgressWidth + 2,
+		ansiGreen + "日" + ansiReset + "本 x": 6,
+	}
+
+	for in, want := range tests {
+		if got := visibleLength(in); got != want {
+			t.Errorf("visibleLength(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Constants used by the page metadata and the oEmbed endpoint.
+const (
+	// The size of the PNG card that is used as the preview image.
+	metaImageWidth  = 1200
+	metaImageHeight = 360
+
+	// The size of the embedded widget. It fills the width of the iframe
+	// and is about 122 pixels high, or 66 with the compact layout. It's
+	// not embedded narrower than the narrowest PNG card, which is the
+	// thumbnail.
+	oembedWidth         = 400
+	oembedHeight        = 122
+	oembedCompactHeight = 66
+	oembedMinWidth      = pngMinWidth
+
+	// How long consumers may cache an oEmbed response, it's short since
+	// the title changes with every track.
+	oembedCacheAge = 60
+)
+
+// pageMeta contains the OpenGraph and Twitter card metadata of a user's
+// page, and the links to its oEmbed representations and feeds.
+type pageMeta struct {
+	Title       string
+	Description string
+	URL         string
+	Image       string
+	ImageWidth  int
+	ImageHeight int
+	OEmbedJSON  string
+	OEmbedXML   string
+	AtomFeed    string
+	RSSFeed     string
+}
+
+// newPageMeta returns the metadata of the page of the given user id. The
+// preview image is the PNG card so that it always shows what is playing.
+func (a *app) newPageMeta(id, description string) *pageMeta {
+	pageURL := a.userURL(id)
+	return &pageMeta{
+		Title:       fmt.Sprintf("%s on lyssnar", id),
+		Description: description,
+		URL:         pageURL,
+		Image:       fmt.Sprintf("%s.png?width=%d", pageURL, metaImageWidth),
+		ImageWidth:  metaImageWidth,
+		ImageHeight: metaImageHeight,
+		OEmbedJSON:  a.baseURL + "/oembed?format=json&url=" + url.QueryEscape(pageURL),
+		OEmbedXML:   a.baseURL + "/oembed?format=xml&url=" + url.QueryEscape(pageURL),
+		AtomFeed:    pageURL + "/feed.atom",
+		RSSFeed:     pageURL + "/feed.rss",
+	}
+}
+
+// userURL returns the absolute URL of the page of the given user id.
+func (a *app) userURL(id string) string {
+	return a.baseURL + "/~" + id
+}
+
+// OEmbedAPI is a rich oEmbed response, see https://oembed.com.
+type OEmbedAPI struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Type            string   `json:"type" xml:"type"`
+	Version         string   `json:"version" xml:"version"`
+	Title           string   `json:"title" xml:"title"`
+	AuthorName      string   `json:"author_name" xml:"author_name"`
+	AuthorURL       string   `json:"author_url" xml:"author_url"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL     string   `json:"provider_url" xml:"provider_url"`
+	CacheAge        int      `json:"cache_age" xml:"cache_age"`
+	ThumbnailURL    string   `json:"thumbnail_url" xml:"thumbnail_url"`
+	ThumbnailWidth  int      `json:"thumbnail_width" xml:"thumbnail_width"`
+	ThumbnailHeight int      `json:"thumbnail_height" xml:"thumbnail_height"`
+	HTML            string   `json:"html" xml:"html"`
+	Width           int      `json:"width" xml:"width"`
+	Height          int      `json:"height" xml:"height"`
+}
+
+// oembedUser returns the user id of the given page URL, an empty string is
+// returned if the URL isn't a user's page on this site.
+func (a *app) oembedUser(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+
+	base, err := url.Parse(a.baseURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) {
+		return ""
+	}
+
+	m := rCurrentlyPlaying.FindStringSubmatch(u.Path)
+	if len(m) == 0 {
+		return ""
+	}
+	return m[1]
+}
+
+// oembedMaxSize returns the maximum width and height that the consumer
+// asked for, zero if it didn't ask for one.
+func oembedMaxSize(r *http.Request) (int, int) {
+	maxWidth, err := strconv.Atoi(r.FormValue("maxwidth"))
+	if err != nil || maxWidth < 0 {
+		maxWidth = 0
+	}
+	maxHeight, err := strconv.Atoi(r.FormValue("maxheight"))
+	if err != nil || maxHeight < 0 {
+		maxHeight = 0
+	}
+	return maxWidth, maxHeight
+}
+
+// oembedSize returns the size and the layout of the embedded widget that
+// fits within the given maximum width and height, the compact layout is
+// used if the full one is too high. False is returned if the widget
+// doesn't fit.
+func oembedSize(maxWidth, maxHeight int) (int, int, string, bool) {
+	width := oembedWidth
+	if maxWidth > 0 && maxWidth < width {
+		width = maxWidth
+	}
+
+	height, layout := oembedHeight, "full"
+	if maxHeight > 0 && maxHeight < height {
+		height, layout = oembedCompactHeight, "compact"
+	}
+
+	if width < oembedMinWidth || (maxHeight > 0 && maxHeight < height) {
+		return 0, 0, "", false
+	}
+	return width, height, layout, true
+}
+
+// oembedThumbnailWidth returns the width of the PNG card that is used as
+// the thumbnail, the card is scaled down to fit within the width of the
+// widget and the maximum height. It's never narrower than pngMinWidth since
+// the widget is at least that wide and oembedCompactHeight high.
+func oembedThumbnailWidth(width, maxHeight int) int {
+	if maxHeight > 0 && maxHeight*400/120 < width {
+		return maxHeight * 400 / 120
+	}
+	return width
+}
+
+// oembed returns a rich oEmbed response for a user's page. The HTML is an
+// iframe of the embeddable widget and the thumbnail is the PNG card, so
+// both show what is playing when they're viewed rather than when the page
+// was embedded.
+func (a *app) oembed(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "xml" {
+		a.oembedError(w, "json", http.StatusNotImplemented, "format must be json or xml")
+		return
+	}
+
+	id := a.oembedUser(r.FormValue("url"))
+	if id == "" {
+		a.oembedError(w, format, http.StatusNotFound, "url is not a lyssnar page")
+		return
+	}
+
+	// The response must fit within the maximum size that the consumer
+	// asked for, there's no response if the widget can't.
+	maxWidth, maxHeight := oembedMaxSize(r)
+	width, height, layout, ok := oembedSize(maxWidth, maxHeight)
+	if !ok {
+		a.oembedError(w, format, http.StatusNotFound, "the widget doesn't fit within maxwidth and maxheight")
+		return
+	}
+
+	c := a.newCard(w, id)
+	switch c.Status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		a.oembedError(w, format, c.Status, "not found")
+		return
+	case http.StatusServiceUnavailable:
+		a.oembedError(w, format, c.Status, "spotify is temporarily unavailable")
+		return
+	default:
+		a.oembedError(w, format, c.Status, "internal server error")
+		return
+	}
+
+	title := c.Title
+	if c.Subtitle != "" {
+		title = c.Subtitle + " - " + c.Title
+	}
+
+	pageURL := a.userURL(id)
+	thumbnailWidth := oembedThumbnailWidth(width, maxHeight)
+	src := pageURL + "/embed"
+	if layout == "compact" {
+		src += "?layout=compact"
+	}
+	o := &OEmbedAPI{
+		Type:         "rich",
+		Version:      "1.0",
+		Title:        title,
+		AuthorName:   id,
+		AuthorURL:    pageURL,
+		ProviderName: "lyssnar",
+		ProviderURL:  a.baseURL + "/",
+		CacheAge:     oembedCacheAge,
+		HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" scrolling="no" title="%s"></iframe>`,
+			html.EscapeString(src), width, height, html.EscapeString(id+" on lyssnar")),
+		ThumbnailURL:    fmt.Sprintf("%s.png?width=%d", pageURL, thumbnailWidth),
+		ThumbnailWidth:  thumbnailWidth,
+		ThumbnailHeight: thumbnailWidth * 120 / 400,
+		Width:           width,
+		Height:          height,
+	}
+
+	if format == "xml" {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		x, _ := xml.Marshal(o)
+		fmt.Fprint(w, xml.Header+string(x))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	j, _ := json.Marshal(o)
+	fmt.Fprint(w, string(j))
+}
+
+// oembedError writes an error in the requested format, the XML error has
+// the same structure as the JSON error.
+func (a *app) oembedError(w http.ResponseWriter, format string, status int, message string) {
+	if format == "xml" {
+		e := struct {
+			XMLName xml.Name `xml:"error"`
+			Status  int      `xml:"status"`
+			Message string   `xml:"message"`
+		}{Status: status, Message: message}
+
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.WriteHeader(status)
+		x, _ := xml.Marshal(e)
+		fmt.Fprint(w, xml.Header+string(x))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, newErrorAPI(status, message))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOEmbedSize(t *testing.T) {
+	tests := []struct {
+		maxWidth, maxHeight int
+		width, height       int
+		layout              string
+		ok                  bool
+	}{
+		{0, 0, 400, 122, "full", true},
+		{1000, 1000, 400, 122, "full", true},
+		{300, 0, 300, 122, "full", true},
+		{0, 100, 400, 66, "compact", true},
+		{250, 66, 250, 66, "compact", true},
+		{199, 0, 0, 0, "", false},
+		{0, 65, 0, 0, "", false},
+	}
+	for _, tt := range tests {
+		width, height, layout, ok := oembedSize(tt.maxWidth, tt.maxHeight)
+		if width != tt.width || height != tt.height || layout != tt.layout || ok != tt.ok {
+			t.Errorf("oembedSize(%d, %d) = %d, %d, %q, %v, want %d, %d, %q, %v", tt.maxWidth, tt.maxHeight, width, height, layout, ok, tt.width, tt.height, tt.layout, tt.ok)
+		}
+	}
+}
+
+// getOEmbed requests the oEmbed response for the page with the given
+// query parameters.
+func getOEmbed(a *app, page string, query url.Values) *httptest.ResponseRecorder {
+	query.Set("url", page)
+	return serve(a, httptest.NewRequest(http.MethodGet, "/oembed?"+query.Encode(), nil))
+}
+
+func TestOEmbed(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	cacheTestObject(a, fakeTrack())
+
+	tests := []struct {
+		query                   url.Values
+		width, height           int
+		src                     string
+		thumbWidth, thumbHeight int
+	}{
+		{url.Values{}, 400, 122, "http://lyssnar.test/~alice/embed", 400, 120},
+		{url.Values{"maxwidth": {"300"}, "maxheight": {"80"}}, 300, 66, "http://lyssnar.test/~alice/embed?layout=compact", 266, 79},
+		{url.Values{"maxheight": {"66"}}, 400, 66, "http://lyssnar.test/~alice/embed?layout=compact", 220, 66},
+	}
+	for _, tt := range tests {
+		w := getOEmbed(a, "http://lyssnar.test/~alice", tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: got status %d: %s", tt.query, w.Code, w.Body)
+		}
+
+		o := &OEmbedAPI{}
+		if err := json.Unmarshal(w.Body.Bytes(), o); err != nil {
+			t.Fatal(err)
+		}
+		if o.Type != "rich" || o.Version != "1.0" || o.Title != "Kraftwerk - Europe Endless" || o.AuthorName != "alice" {
+			t.Errorf("%v: got %+v", tt.query, o)
+		}
+		if o.Width != tt.width || o.Height != tt.height || o.ThumbnailWidth != tt.thumbWidth || o.ThumbnailHeight != tt.thumbHeight {
+			t.Errorf("%v: got %dx%d with a %dx%d thumbnail, want %dx%d with a %dx%d thumbnail", tt.query, o.Width, o.Height, o.ThumbnailWidth, o.ThumbnailHeight, tt.width, tt.height, tt.thumbWidth, tt.thumbHeight)
+		}
+		if want := "http://lyssnar.test/~alice.png?width=" + strconv.Itoa(tt.thumbWidth); o.ThumbnailURL != want {
+			t.Errorf("%v: got thumbnail %q, want %q", tt.query, o.ThumbnailURL, want)
+		}
+		if !strings.Contains(o.HTML, `src="`+strings.ReplaceAll(tt.src, "&", "&amp;")+`"`) {
+			t.Errorf("%v: html %q doesn't embed %s", tt.query, o.HTML, tt.src)
+		}
+	}
+
+	w := getOEmbed(a, "http://lyssnar.test/~alice", url.Values{"format": {"xml"}})
+	var x struct {
+		Type string `xml:"type"`
+		HTML string `xml:"html"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &x); err != nil {
+		t.Fatal(err)
+	}
+	if x.Type != "rich" || !strings.HasPrefix(x.HTML, "<iframe ") {
+		t.Errorf("got %+v", x)
+	}
+}
+
+func TestOEmbedErrors(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	cacheTestObject(a, fakeTrack())
+
+	tests := []struct {
+		page   string
+		query  url.Values
+		status int
+	}{
+		{"http://lyssnar.test/~alice", url.Values{"format": {"yaml"}}, http.StatusNotImplemented},
+		{"http://lyssnar.test/~alice", url.Values{"maxwidth": {"100"}}, http.StatusNotFound},
+		{"http://lyssnar.test/~alice", url.Values{"maxheight": {"50"}}, http.StatusNotFound},
+		{"http://example.com/~alice", url.Values{}, http.StatusNotFound},
+		{"http://lyssnar.test/~bob", url.Values{}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := getOEmbed(a, tt.page, tt.query); w.Code != tt.status {
+			t.Errorf("%s %v: got status %d, want %d", tt.page, tt.query, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Constants that decides whether a play qualifies as a listen, the rules
+// are the same as the ones that are commonly used for scrobbling. A track
+// must be longer than minListenDuration and it must have been played for
+// at least half of its duration or for maxListenProgress, whichever comes
+// first.
+const (
+	minListenDuration = 30 * time.Second
+	maxListenProgress = 4 * time.Minute
+)
+
+// play contains a track or an episode that a user has played.
+type play struct {
+	// The id of the play.
+	ID int64
+
+	// The id of the user that played the item.
+	UserID string
+
+	// The Spotify ID of the track, episode or chapter.
+	ItemID string
+
+	// The type of the item, "track", "episode" or "chapter".
+	ItemType string
+
+	// The name of the track, episode or chapter.
+	Name string
+
+	// Comma separated list of artists, the name of the show for episodes
+	// or the authors for chapters.
+	Artists string
+
+	// The name of the album or audiobook, empty for episodes.
+	Album string
+
+	// The URL to the album or show art.
+	ImageURL string
+
+	// The URL to the item on Spotify.
+	URL string
+
+	// The length of the item in milliseconds.
+	DurationMS int
+
+	// The furthest progress into the item that has been observed.
+	ProgressMS int
+
+	// Whether or not the play qualifies as a listen.
+	Listened bool
+
+	// When the play first qualified as a listen, the zero time if it
+	// hasn't.
+	ListenedAt time.Time
+
+	// When the play started.
+	StartedAt time.Time
+
+	// When the play was last observed.
+	UpdatedAt time.Time
+}
+
+// newPlay constructs a play from the given currently playing object, nil
+// is returned if the object doesn't contain anything that we can record.
+// Ads, unknown items and local files, which have no ID, aren't recorded.
+func newPlay(userID string, cpo *CurrentlyPlayingObject, now time.Time) *play {
+	item := newPlayingItem(cpo)
+	if item == nil || item.ID == "" {
+		return nil
+	}
+
+	progress := 0
+	if cpo.ProgressMS != nil {
+		progress = *cpo.ProgressMS
+	}
+
+	p := &play{
+		UserID:     userID,
+		ItemID:     item.ID,
+		ItemType:   item.Type,
+		Name:       item.Name,
+		Artists:    item.Artists,
+		Album:      item.Album,
+		ImageURL:   item.Image,
+		URL:        item.URL,
+		DurationMS: item.DurationMS,
+		ProgressMS: progress,
+		StartedAt:  now.Add(-time.Duration(progress) * time.Millisecond),
+		UpdatedAt:  now,
+	}
+
+	if p.Listened = p.isListen(); p.Listened {
+		p.ListenedAt = now
+	}
+	return p
+}
+
+// isListen returns true if the play qualifies as a listen.
+func (p *play) isListen() bool {
+	duration := time.Duration(p.DurationMS) * time.Millisecond
+	progress := time.Duration(p.ProgressMS) * time.Millisecond
+
+	if duration <= minListenDuration {
+		return false
+	}
+
+	return progress >= duration/2 || progress >= maxListenProgress
+}
+
+// artistNames returns a comma separated list of the artist names.
+func artistNames(artists []ArtistObjectSimplified) string {
+	var names []string
+	for _, a := range artists {
+		names = append(names, a.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// imageURL returns the URL of the last image that has a height between 200
+// and 500 pixels, an empty string is returned if there is no such image.
+func imageURL(images []ImageObject) string {
+	url := ""
+	for _, i := range images {
+		if i.Height > 200 && i.Height < 500 {
+			url = i.URL
+		}
+	}
+	return url
+}
+
+// publicCurrentlyPlayingObject returns a copy of the currently playing
+// object that can be shown to anyone. The device is reduced to its name,
+// type and whether it's active, its id and volume are left out.
+func publicCurrentlyPlayingObject(cpo *CurrentlyPlayingObject) *CurrentlyPlayingObject {
+	if cpo == nil || cpo.Device == nil {
+		return cpo
+	}
+
+	c := *cpo
+	c.Device = &DeviceObject{
+		IsActive: cpo.Device.IsActive,
+		Name:     cpo.Device.Name,
+		Type:     cpo.Device.Type,
+	}
+	return &c
+}
+
+// deviceName formats the device as e.g. "Kitchen speaker (Speaker)", an
+// empty string is returned if the device isn't known.
+func deviceName(d *DeviceObject) string {
+	if d == nil || d.Name == "" {
+		return ""
+	}
+	if d.Type == "" {
+		return d.Name
+	}
+	return fmt.Sprintf("%s (%s)", d.Name, d.Type)
+}
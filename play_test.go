@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsListen(t *testing.T) {
+	tests := []struct {
+		duration, progress time.Duration
+		want               bool
+	}{
+		{3 * time.Minute, 0, false},
+		{3 * time.Minute, 89 * time.Second, false},
+		{3 * time.Minute, 90 * time.Second, true},
+		{20 * time.Minute, 3 * time.Minute, false},
+		{20 * time.Minute, maxListenProgress, true},
+		{minListenDuration, minListenDuration, false},
+		{minListenDuration + time.Second, minListenDuration, true},
+	}
+
+	for _, tt := range tests {
+		p := &play{DurationMS: int(tt.duration.Milliseconds()), ProgressMS: int(tt.progress.Milliseconds())}
+		if got := p.isListen(); got != tt.want {
+			t.Errorf("isListen() of %v into %v = %v, want %v", tt.progress, tt.duration, got, tt.want)
+		}
+	}
+}
+
+func TestNewPlay(t *testing.T) {
+	now := time.Now()
+
+	p := newPlay("alice", fakeTrack(), now)
+	if p == nil {
+		t.Fatal("track wasn't recorded")
+	}
+	if p.ItemID != "6wHFd0WTpNZXjHLvVKkZCW" || p.ItemType != "track" || p.Artists != "Kraftwerk" || p.Album != "Trans-Europe Express" {
+		t.Errorf("got %+v", p)
+	}
+	if want := now.Add(-42 * time.Second); !p.StartedAt.Equal(want) {
+		t.Errorf("started at %v, want %v", p.StartedAt, want)
+	}
+	if p.Listened || !p.ListenedAt.IsZero() {
+		t.Errorf("play is a listen after %d ms", p.ProgressMS)
+	}
+
+	for name, cpo := range map[string]*CurrentlyPlayingObject{
+		"nothing": nil,
+		"local":   fakeLocalTrack(),
+		"ad":      fakeAd(),
+	} {
+		if p := newPlay("alice", cpo, now); p != nil {
+			t.Errorf("%s was recorded as %+v", name, p)
+		}
+	}
+}
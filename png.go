@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Constants for the size of the PNG card. The layout is the same as the SVG
+// card, which is 400x120, scaled to the requested width.
+const (
+	pngDefaultWidth = 800
+	pngMinWidth     = 200
+	pngMaxWidth     = 1600
+)
+
+// Constants used by the PNG card cache. The cards are drawn again once the
+// art cache has given up on a failed image.
+const (
+	pngCacheTTL  = artCacheFailureTTL
+	pngCacheSize = 200
+)
+
+// The largest art, in pixels, that is decoded. Spotify's art is at most
+// 640x640, larger images would take a lot of memory to decode.
+const artMaxPixels = 2048 * 2048
+
+// The fonts that are used on the PNG card, they're parsed once.
+var (
+	pngFontsOnce sync.Once
+	pngRegular   *opentype.Font
+	pngBold      *opentype.Font
+)
+
+// loadPNGFonts parses the embedded Go fonts.
+func loadPNGFonts() {
+	var err error
+	if pngRegular, err = opentype.Parse(goregular.TTF); err != nil {
+		log.Fatalf("can't parse regular font: %v", err)
+	}
+	if pngBold, err = opentype.Parse(gobold.TTF); err != nil {
+		log.Fatalf("can't parse bold font: %v", err)
+	}
+}
+
+// newPNGCache returns an empty cache of encoded PNG cards keyed by what is
+// drawn on them, drawing and encoding a card is much slower than the SVG.
+func newPNGCache() *ttlCache[string, []byte] {
+	return newTTLCache[string, []byte](pngCacheSize)
+}
+
+// pngCacheKey returns the key of the card drawn with the given theme and
+// width. The progress is part of the key as the width of the drawn bar, so
+// that the key only changes when the bar does.
+func pngCacheKey(c *card, t *cardTheme, width int) string {
+	var images []string
+	for _, i := range c.Images {
+		images = append(images, i.URL)
+	}
+
+	bar := -1
+	if c.DurationMS > 0 {
+		bar = int(264 * c.progress() * float64(width) / 400)
+	}
+
+	return strings.Join([]string{
+		fmt.Sprint(*t),
+		strconv.Itoa(width),
+		c.State,
+		c.Title,
+		c.Subtitle,
+		c.ImageURL,
+		strings.Join(images, " "),
+		strconv.Itoa(bar),
+	}, "\x00")
+}
+
+// parseHexColor parses a color in the #rrggbb format.
+func parseHexColor(s string) color.Color {
+	var c color.RGBA
+	c.A = 255
+	fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B)
+	return c
+}
+
+// cardPNG renders the now playing card for the given user id as a PNG
+// image. The width can be set with the width parameter.
+func (a *app) cardPNG(w http.ResponseWriter, r *http.Request, id string) {
+	width := pngDefaultWidth
+	if v := r.FormValue("width"); v != "" {
+		var err error
+		if width, err = strconv.Atoi(v); err != nil || width < pngMinWidth || width > pngMaxWidth {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, newErrorAPI(http.StatusBadRequest, fmt.Sprintf("width must be between %d and %d", pngMinWidth, pngMaxWidth)))
+			return
+		}
+	}
+
+	c := a.newCard(w, id)
+	t := cardThemeFromRequest(r)
+	key := pngCacheKey(c, t, width)
+
+	data, _, _, err := a.pngs.get(key, func() ([]byte, time.Duration, error) {
+		img, err := a.drawCard(c, t, width)
+		if err != nil {
+			return nil, 0, fmt.Errorf("can't render: %w", err)
+		}
+
+		var b bytes.Buffer
+		if err := png.Encode(&b, img); err != nil {
+			return nil, 0, fmt.Errorf("can't encode: %w", err)
+		}
+		return b.Bytes(), pngCacheTTL, nil
+	})
+	if err != nil {
+		log.Printf("can't draw png card for %s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setCardHeaders(w)
+	w.Header().Set("Content-Type", "image/png")
+	w.WriteHeader(c.Status)
+	w.Write(data)
+}
+
+// drawCard draws the card with the given width.
+func (a *app) drawCard(c *card, t *cardTheme, width int) (image.Image, error) {
+	pngFontsOnce.Do(loadPNGFonts)
+
+	// All coordinates are in the 400x120 layout of the SVG card and are
+	// scaled with s.
+	s := float64(width) / 400
+	px := func(v float64) int { return int(v * s) }
+	rect := func(x, y, w, h float64) image.Rectangle {
+		return image.Rect(px(x), px(y), px(x+w), px(y+h))
+	}
+	fill := func(img draw.Image, r image.Rectangle, hex string) {
+		draw.Draw(img, r, image.NewUniform(parseHexColor(hex)), image.Point{}, draw.Src)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, px(120)))
+	fill(img, img.Bounds(), t.Border)
+	fill(img, image.Rect(1, 1, width-1, px(120)-1), t.Background)
+
+	// Draw the art, or a placeholder if there is none.
+	art := rect(12, 12, 96, 96)
+	if src := a.cardArt(c, art.Dx()); src != nil {
+		xdraw.CatmullRom.Scale(img, art, src, src.Bounds(), draw.Src, nil)
+	} else {
+		fill(img, art, t.Placeholder)
+		if err := drawText(img, pngRegular, 40*s, t.Muted, "♪", art.Min.X+art.Dx()/2-px(12), px(72)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Draw the text, it's truncated to fit next to the art.
+	maxWidth := px(264)
+	lines := []struct {
+		font  *opentype.Font
+		size  float64
+		color string
+		text  string
+		y     float64
+	}{
+		{pngRegular, 12, t.Muted, c.State, 32},
+		{pngBold, 16, t.Title, c.Title, 56},
+		{pngRegular, 14, t.Text, c.Subtitle, 78},
+	}
+	for _, l := range lines {
+		face, err := opentype.NewFace(l.font, &opentype.FaceOptions{Size: l.size * s, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		text := fitText(face, l.text, maxWidth)
+		face.Close()
+
+		if err := drawText(img, l.font, l.size*s, l.color, text, px(124), px(l.y)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Draw the progress bar.
+	if c.DurationMS > 0 {
+		fill(img, rect(124, 96, 264, 4), t.Placeholder)
+		fill(img, rect(124, 96, 264*c.progress(), 4), t.Accent)
+	}
+
+	return img, nil
+}
+
+// cardArt returns the decoded art of the card that is drawn with the given
+// size, nil is returned if there's no art or if it can't be decoded. The
+// dimensions are checked before the art is decoded, since a small image can
+// claim to be huge.
+func (a *app) cardArt(c *card, size int) image.Image {
+	data, _ := a.art.get(c.imageURLFor(size))
+	if data == nil {
+		return nil
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("can't decode art: %v", err)
+		return nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > artMaxPixels/cfg.Height {
+		log.Printf("can't decode art of %dx%d pixels", cfg.Width, cfg.Height)
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("can't decode art: %v", err)
+		return nil
+	}
+	return img
+}
+
+// fitText truncates the text until it's at most maxWidth pixels wide.
+func fitText(face font.Face, text string, maxWidth int) string {
+	r := []rune(text)
+	for n := len(r); n > 0; n-- {
+		t := truncate(text, n)
+		if font.MeasureString(face, t).Ceil() <= maxWidth {
+			return t
+		}
+	}
+	return ""
+}
+
+// drawText draws the text with its baseline at the given position.
+func drawText(img draw.Image, f *opentype.Font, size float64, hex, text string, x, y int) error {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(parseHexColor(hex)),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+	return nil
+}
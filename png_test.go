@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCardPNG(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	f := useFakeArt(a)
+	cacheTestObject(a, fakeTrack())
+
+	tests := []struct {
+		query         string
+		width, height int
+	}{
+		{"", pngDefaultWidth, pngDefaultWidth * 120 / 400},
+		{"?width=200", 200, 60},
+		{"?width=1600&theme=spotify", 1600, 480},
+	}
+	for _, tt := range tests {
+		w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice.png"+tt.query, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("%q: got status %d and %q", tt.query, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+			t.Errorf("%q: got %dx%d, want %dx%d", tt.query, b.Dx(), b.Dy(), tt.width, tt.height)
+		}
+	}
+	if f.requests == 0 {
+		t.Error("the art wasn't drawn")
+	}
+
+	for _, width := range []string{"199", "1601", "wide"} {
+		if w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice.png?width="+width, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("width %s: got status %d, want %d", width, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCardPNGCache(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	useFakeArt(a)
+
+	// The progress of a paused track doesn't move, so the card stays the
+	// same.
+	paused := fakeTrack()
+	paused.IsPlaying = false
+	cacheTestObject(a, paused)
+
+	get := func() []byte {
+		w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice.png?width=200", nil))
+		return w.Body.Bytes()
+	}
+	first := get()
+	if len(a.pngs.entries) != 1 {
+		t.Fatalf("got %d cached cards, want 1", len(a.pngs.entries))
+	}
+	if !bytes.Equal(get(), first) || len(a.pngs.entries) != 1 {
+		t.Error("the card was drawn again")
+	}
+
+	// The key only changes when the drawn progress bar does.
+	c := &card{Title: "title", DurationMS: 400000, ProgressMS: 100000}
+	key := pngCacheKey(c, cardThemes["light"], 200)
+	c.ProgressMS += 100
+	if pngCacheKey(c, cardThemes["light"], 200) != key {
+		t.Error("key changed although the bar didn't")
+	}
+	c.ProgressMS += 100000
+	if pngCacheKey(c, cardThemes["light"], 200) == key {
+		t.Error("key didn't change with the bar")
+	}
+	if pngCacheKey(c, cardThemes["dark"], 200) == pngCacheKey(c, cardThemes["light"], 200) {
+		t.Error("key didn't change with the theme")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// poll walks through all stored credentials every interval and records
+// what each user is playing. It never returns.
+func (a *app) poll(interval time.Duration) {
+	for {
+		a.pollAll()
+		time.Sleep(interval)
+	}
+}
+
+// pollAll records the currently playing item for every user that has
+// authorized lyssnar.
+func (a *app) pollAll() {
+	ids, err := a.getCredentialIDs()
+	if err != nil {
+		log.Printf("poller: can't get credentials: %v", err)
+		return
+	}
+
+	for _, id := range ids {
+		err := a.pollUser(id)
+
+		// There's no point in polling the rest of the users if Spotify
+		// is unavailable, we'll try again on the next round.
+		if _, ok := isUnavailable(err); ok {
+			log.Printf("poller: %v", err)
+			return
+		}
+
+		if err != nil {
+			log.Printf("poller: can't record play for %s: %v", id, err)
+		}
+	}
+}
+
+// pollUser fetches the currently playing item for the given user id, the
+// item is recorded in the play table by getCurrentlyPlayingObject.
+func (a *app) pollUser(id string) error {
+	_, err := a.getCurrentlyPlayingObject(id)
+	return err
+}
+
+// recordPlay stores the item in the given currently playing object. A new
+// play is inserted unless the item is a continuation of the last play that
+// was recorded for the user, in which case the progress of the existing
+// play is updated instead.
+func (a *app) recordPlay(id string, cpo *CurrentlyPlayingObject, now time.Time) error {
+	// Paused items are not recorded, the play will be picked up again
+	// when the playback is resumed.
+	if cpo == nil || !cpo.IsPlaying {
+		return nil
+	}
+
+	p := newPlay(id, cpo, now)
+	if p == nil {
+		return nil
+	}
+
+	// Plays are recorded from both the poller and the http handlers, make
+	// sure that they don't insert the same play twice.
+	unlock := a.playLocks.lock(id)
+	defer unlock()
+
+	last, err := a.getLastPlay(id)
+	if err != nil {
+		return err
+	}
+
+	if last != nil && last.continuedBy(p) {
+		if p.ProgressMS > last.ProgressMS {
+			last.ProgressMS = p.ProgressMS
+		}
+		if !last.Listened && last.isListen() {
+			last.Listened = true
+			last.ListenedAt = now
+		}
+		last.UpdatedAt = now
+		return a.updatePlay(last)
+	}
+
+	return a.insertPlay(p)
+}
+
+// continuedBy returns true if the next play is a continuation of p, that
+// is, the same item is still playing and it hasn't been restarted since
+// it was last observed.
+func (p *play) continuedBy(next *play) bool {
+	if p.ItemID != next.ItemID {
+		return false
+	}
+
+	// The item has been restarted from the beginning.
+	if next.ProgressMS < p.ProgressMS {
+		return false
+	}
+
+	// The item should have ended a long time ago, so this must be a new
+	// play of the same item.
+	end := p.StartedAt.Add(time.Duration(p.DurationMS) * time.Millisecond)
+	if next.UpdatedAt.After(end.Add(time.Duration(p.DurationMS) * time.Millisecond)) {
+		return false
+	}
+
+	return true
+}
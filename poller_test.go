@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDB returns an app with an empty SQLite database.
+func newTestDB(t *testing.T) *app {
+	t.Helper()
+
+	a := &app{dbURL: "sqlite://" + filepath.Join(t.TempDir(), "lyssnar.db")}
+	if err := a.initDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.db.Close() })
+
+	return a
+}
+
+// fakeTrackAt returns the fake track with the given progress.
+func fakeTrackAt(progress time.Duration) *CurrentlyPlayingObject {
+	cpo := fakeTrack()
+	ms := int(progress.Milliseconds())
+	cpo.ProgressMS = &ms
+	return cpo
+}
+
+func TestContinuedBy(t *testing.T) {
+	started := time.Now()
+	last := &play{ItemID: "a", DurationMS: 200000, ProgressMS: 60000, StartedAt: started, UpdatedAt: started.Add(time.Minute)}
+
+	tests := []struct {
+		name string
+		next *play
+		want bool
+	}{
+		{"progressed", &play{ItemID: "a", ProgressMS: 90000, UpdatedAt: started.Add(90 * time.Second)}, true},
+		{"paused", &play{ItemID: "a", ProgressMS: 60000, UpdatedAt: started.Add(5 * time.Minute)}, true},
+		{"other item", &play{ItemID: "b", ProgressMS: 90000, UpdatedAt: started.Add(90 * time.Second)}, false},
+		{"restarted", &play{ItemID: "a", ProgressMS: 1000, UpdatedAt: started.Add(90 * time.Second)}, false},
+		{"long after", &play{ItemID: "a", ProgressMS: 90000, UpdatedAt: started.Add(7 * time.Minute)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := last.continuedBy(tt.next); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecordPlay(t *testing.T) {
+	a := newTestDB(t)
+	t0 := time.Now().Truncate(time.Second)
+
+	record := func(cpo *CurrentlyPlayingObject, now time.Time) {
+		t.Helper()
+		if err := a.recordPlay("alice", cpo, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func() int {
+		t.Helper()
+		var n int
+		if err := a.db.QueryRow("SELECT COUNT(*) FROM play WHERE user_id = $1", "alice").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	record(fakeTrackAt(42*time.Second), t0)
+	record(fakeTrackAt(102*time.Second), t0.Add(time.Minute))
+
+	p, err := a.getLastPlay("alice")
+	if err != nil || p == nil {
+		t.Fatalf("got %v and %v", p, err)
+	}
+	if n := count(); n != 1 || p.ProgressMS != 102000 || p.Listened {
+		t.Fatalf("got %d plays, the last at %d ms and listened %v", n, p.ProgressMS, p.Listened)
+	}
+
+	// The track is a listen once half of it has been played, and it
+	// stays a listen from that point on.
+	record(fakeTrackAt(222*time.Second), t0.Add(3*time.Minute))
+	record(fakeTrackAt(232*time.Second), t0.Add(190*time.Second))
+
+	if p, _ = a.getLastPlay("alice"); !p.Listened || !p.ListenedAt.Equal(t0.Add(3*time.Minute)) || p.ProgressMS != 232000 {
+		t.Errorf("got listened %v at %v after %d ms", p.Listened, p.ListenedAt, p.ProgressMS)
+	}
+
+	// Paused items, ads and local files aren't recorded.
+	paused := fakeTrackAt(10 * time.Second)
+	paused.IsPlaying = false
+	record(paused, t0.Add(4*time.Minute))
+	record(fakeAd(), t0.Add(4*time.Minute))
+	record(fakeLocalTrack(), t0.Add(4*time.Minute))
+	if n := count(); n != 1 {
+		t.Errorf("got %d plays, want 1", n)
+	}
+
+	// Starting the track over is a new play.
+	record(fakeTrackAt(10*time.Second), t0.Add(5*time.Minute))
+	if n := count(); n != 2 {
+		t.Errorf("got %d plays, want 2", n)
+	}
+	if p, _ = a.getLastPlay("alice"); p.Listened || p.ProgressMS != 10000 {
+		t.Errorf("got listened %v after %d ms", p.Listened, p.ProgressMS)
+	}
+}
@@ -11,6 +11,7 @@ import (
 var (
 	rAuthorize                = regexp.MustCompile(`^/authorize$`)
 	rCallback                 = regexp.MustCompile(`^/callback$`)
+	rSettings                 = regexp.MustCompile(`^/settings$`)
 	rCss                      = regexp.MustCompile(`^/lyssnar.css$`)
 	rFavicon                  = regexp.MustCompile(`^/favicon.ico$`)
 	rFavicon16                = regexp.MustCompile(`^/favicon-16x16.png$`)
@@ -19,6 +20,15 @@ var (
 	rCurrentlyPlaying         = regexp.MustCompile(`^/~([a-zA-Z0-9-]+)$`)
 	rCurrentlyPlayingAPI      = regexp.MustCompile(`^/v1/user/([a-zA-Z0-9-]+)/currently-playing$`)
 	rCurrentlyPlayingShortAPI = regexp.MustCompile(`^/v1/user/([a-zA-Z0-9-]+)/currently-playing-short$`)
+	rCurrentlyPlayingStream   = regexp.MustCompile(`^/v1/user/([a-zA-Z0-9-]+)/currently-playing/stream$`)
+	rRecentlyPlayedAPI        = regexp.MustCompile(`^/v1/user/([a-zA-Z0-9-]+)/recently-played$`)
+	rNowPlayingAPI            = regexp.MustCompile(`^/v2/users/([a-zA-Z0-9-]+)/now-playing$`)
+	rCardSVG                  = regexp.MustCompile(`^/~([a-zA-Z0-9-]+)\.svg$`)
+	rCardSVGAPI               = regexp.MustCompile(`^/v1/user/([a-zA-Z0-9-]+)/card\.svg$`)
+	rCardPNG                  = regexp.MustCompile(`^/~([a-zA-Z0-9-]+)\.png$`)
+	rOEmbed                   = regexp.MustCompile(`^/oembed$`)
+	rEmbed                    = regexp.MustCompile(`^/~([a-zA-Z0-9-]+)/embed$`)
+	rFeed                     = regexp.MustCompile(`^/~([a-zA-Z0-9-]+)/feed\.(atom|rss)$`)
 )
 
 // route handles all http requests and routes them to the appropriate
@@ -40,19 +50,42 @@ func (a *app) route(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		a.landing(w, r)
 	} else if m := rCurrentlyPlaying.FindStringSubmatch(r.URL.Path); len(m) > 0 {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		a.currentlyPlaying(w, r, m[1])
+		a.currentlyPlayingNegotiated(w, r, m[1])
 	} else if m := rCurrentlyPlayingAPI.FindStringSubmatch(r.URL.Path); len(m) > 0 {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		a.currentlyPlayingAPI(w, r, m[1])
 	} else if m := rCurrentlyPlayingShortAPI.FindStringSubmatch(r.URL.Path); len(m) > 0 {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		a.currentlyPlayingShortAPI(w, r, m[1])
+	} else if m := rCurrentlyPlayingStream.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.currentlyPlayingStreamAPI(w, r, m[1])
+	} else if m := rRecentlyPlayedAPI.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		a.recentlyPlayedAPI(w, r, m[1])
+	} else if m := rNowPlayingAPI.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		a.nowPlayingAPI(w, r, m[1])
+	} else if m := rCardSVG.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.cardSVG(w, r, m[1])
+	} else if m := rCardSVGAPI.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.cardSVG(w, r, m[1])
+	} else if m := rCardPNG.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.cardPNG(w, r, m[1])
+	} else if m := rEmbed.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		a.embed(w, r, m[1])
+	} else if m := rFeed.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.feed(w, r, m[1], m[2])
+	} else if m := rOEmbed.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		a.oembed(w, r)
 	} else if m := rAuthorize.FindStringSubmatch(r.URL.Path); len(m) > 0 {
-		http.Redirect(w, r, a.conf.AuthCodeURL(newUUID()), http.StatusTemporaryRedirect)
+		a.authorize(w, r)
 	} else if m := rCallback.FindStringSubmatch(r.URL.Path); len(m) > 0 {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		a.callback(w, r)
+	} else if m := rSettings.FindStringSubmatch(r.URL.Path); len(m) > 0 {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		a.settings(w, r)
 	} else {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		a.errorNotFound(w, r)
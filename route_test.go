@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newTestApp returns an app that talks to a fake Spotify server which
+// runs the given script for alice. Nothing is cached, so every request
+// advances the script by one step.
+func newTestApp(t *testing.T, script ...string) *app {
+	t.Helper()
+
+	spotify := httptest.NewServer(newFakeSpotify("alice", script))
+	t.Cleanup(spotify.Close)
+
+	a := newTestDB(t)
+	a.conf = &oauth2.Config{
+		RedirectURL:  "http://lyssnar.test/callback",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       scopes(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.URL + "/authorize",
+			TokenURL: spotify.URL + "/api/token",
+		},
+	}
+	a.apiURL = spotify.URL
+	a.baseURL = "http://lyssnar.test"
+	a.sessionKey = newSessionKey("")
+	a.cache = newPlayingCache(0)
+	a.recent = newRecentlyPlayedCache(0)
+	a.contexts = newMetadataCache()
+	a.art = newArtCache()
+	a.pngs = newPNGCache()
+	a.httpClient = &http.Client{
+		Transport: newScheduler(100),
+		Timeout:   5 * time.Second,
+	}
+	a.stream = newStreamHub(a, time.Hour)
+
+	return a
+}
+
+// serve routes the request through the app and returns the response.
+func serve(a *app, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.route(w, r)
+	return w
+}
+
+// authorizeTestUser runs the authorization flow from /authorize through
+// the fake Spotify server and back to /callback, the response of the
+// callback is returned.
+func authorizeTestUser(t *testing.T, a *app, query string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/authorize?"+query, nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("GET /authorize returned %d: %s", w.Code, w.Body)
+	}
+
+	// The fake Spotify server approves right away and redirects back to
+	// the callback, which isn't followed since it's not a real server.
+	cli := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := cli.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return serve(a, r)
+}
+
+// getNowPlaying requests what alice is playing from the v2 API and decodes
+// the response if there is one.
+func getNowPlaying(t *testing.T, a *app) (*httptest.ResponseRecorder, *NowPlayingAPI) {
+	t.Helper()
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/v2/users/alice/now-playing", nil))
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+
+	n := &NowPlayingAPI{}
+	if err := json.Unmarshal(w.Body.Bytes(), n); err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body, err)
+	}
+	return w, n
+}
+
+func TestNowPlayingScript(t *testing.T) {
+	a := newTestApp(t, fakeStepTrack, fakeStepEpisode, fakeStepChapter, fakeStepLocal, fakeStepAd, fakeStepNothing, fakeStepPrivate, fakeStepExpired, fakeStepTrack, fakeStepRateLimited)
+	if w := authorizeTestUser(t, a, ""); w.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		step   string
+		status int
+		kind   string
+		local  bool
+		stale  bool
+	}{
+		{step: fakeStepTrack, status: http.StatusOK, kind: "track"},
+		{step: fakeStepEpisode, status: http.StatusOK, kind: "episode"},
+		{step: fakeStepChapter, status: http.StatusOK, kind: "chapter"},
+		{step: fakeStepLocal, status: http.StatusOK, kind: "track", local: true},
+		{step: fakeStepAd, status: http.StatusOK, kind: "ad"},
+		{step: fakeStepNothing, status: http.StatusNoContent},
+		{step: fakeStepPrivate, status: http.StatusNoContent},
+
+		// The token is refreshed and the request retried, which runs the
+		// next step.
+		{step: fakeStepExpired, status: http.StatusOK, kind: "track"},
+
+		// The last known object is served while rate limited.
+		{step: fakeStepRateLimited, status: http.StatusOK, kind: "track", stale: true},
+	}
+
+	for _, tt := range tests {
+		w, n := getNowPlaying(t, a)
+		if w.Code != tt.status {
+			t.Fatalf("%s: got status %d, want %d: %s", tt.step, w.Code, tt.status, w.Body)
+		}
+		if n == nil {
+			continue
+		}
+		if n.Kind != tt.kind || n.IsLocal != tt.local || n.Stale != tt.stale {
+			t.Errorf("%s: got kind %q, local %v and stale %v, want %q, %v and %v", tt.step, n.Kind, n.IsLocal, n.Stale, tt.kind, tt.local, tt.stale)
+		}
+		if n.Stale && n.EndsAt != nil {
+			t.Errorf("%s: stale object has ends_at %v", tt.step, n.EndsAt)
+		}
+	}
+}
+
+func TestNotAuthorized(t *testing.T) {
+	a := newTestApp(t)
+
+	for _, path := range []string{
+		"/v1/user/bob/currently-playing",
+		"/v1/user/bob/currently-playing-short",
+		"/v2/users/bob/now-playing",
+		"/~bob/feed.atom",
+	} {
+		if w := serve(a, httptest.NewRequest(http.MethodGet, path, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestNowPlayingRateLimited(t *testing.T) {
+	a := newTestApp(t, fakeStepRateLimited)
+	authorizeTestUser(t, a, "")
+
+	// There is no last known object to fall back on.
+	w, _ := getNowPlaying(t, a)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is missing")
+	}
+}
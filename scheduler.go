@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Constants used by the outbound request scheduler.
+const (
+	// The longest time a request waits for the request budget before
+	// it's rejected.
+	schedulerMaxWait = 5 * time.Second
+
+	// The Retry-After that is used when Spotify doesn't send one.
+	schedulerDefaultRetryAfter = 5 * time.Second
+
+	// The first and longest back off after server errors, the back off
+	// doubles for each consecutive error.
+	schedulerMinBackoff = time.Second
+	schedulerMaxBackoff = time.Minute
+)
+
+// unavailableError is returned for requests to Spotify that are rejected
+// because of rate limiting or server errors.
+type unavailableError struct {
+	// How long the caller should wait before trying again.
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("spotify is temporarily unavailable, retry after %s", e.retryAfter)
+}
+
+// isUnavailable returns the time to wait before trying again if the error
+// is caused by Spotify being temporarily unavailable.
+func isUnavailable(err error) (time.Duration, bool) {
+	var ue *unavailableError
+	if errors.As(err, &ue) {
+		return ue.retryAfter, true
+	}
+	return 0, false
+}
+
+// setRetryAfter sets the Retry-After header if the error tells that
+// Spotify is unavailable, true is returned if it does.
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	d, ok := isUnavailable(err)
+	if ok {
+		w.Header().Set("Retry-After", retryAfterSeconds(d))
+	}
+	return ok
+}
+
+// writeUnavailable writes the Retry-After header and the 503 status if the
+// error tells that Spotify is unavailable, true is returned if it does and
+// the caller only has to write the body.
+func writeUnavailable(w http.ResponseWriter, err error) bool {
+	if !setRetryAfter(w, err) {
+		return false
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
+
+// retryAfterSeconds formats the duration as whole seconds for the
+// Retry-After header, it's rounded up and is at least one second.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+// scheduler is an http.RoundTripper that all requests to Spotify go
+// through. It enforces a global request budget with a token bucket, stops
+// sending requests for as long as Spotify tells us to when we're rate
+// limited and backs off exponentially on server errors. Rate limits apply
+// to all requests while server errors only back off the endpoint that
+// failed, so a failing lookup doesn't stop the currently playing requests.
+type scheduler struct {
+	base http.RoundTripper
+
+	// Number of requests per second and the size of the bucket.
+	rate  float64
+	burst float64
+
+	mu       sync.Mutex
+	tokens   float64
+	last     time.Time
+	blocked  time.Time
+	backoffs map[string]*schedulerBackoff
+}
+
+// schedulerBackoff holds the back off of an endpoint that responded with
+// server errors.
+type schedulerBackoff struct {
+	until    time.Time
+	failures int
+}
+
+// schedulerEndpoint returns the endpoint that server errors are backed off
+// for, which is the host and path of the request.
+func schedulerEndpoint(req *http.Request) string {
+	return req.URL.Host + req.URL.Path
+}
+
+// newScheduler returns a scheduler that allows rate requests per second.
+func newScheduler(rate float64) *scheduler {
+	return &scheduler{
+		base:     http.DefaultTransport,
+		rate:     rate,
+		burst:    rate,
+		tokens:   rate,
+		last:     time.Now(),
+		backoffs: make(map[string]*schedulerBackoff),
+	}
+}
+
+// reserve takes a token from the bucket for a request to the endpoint, it
+// returns how long the caller must wait before the request can be sent.
+func (s *scheduler) reserve(endpoint string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(s.blocked) {
+		return 0, &unavailableError{retryAfter: s.blocked.Sub(now)}
+	}
+	if b, ok := s.backoffs[endpoint]; ok && now.Before(b.until) {
+		return 0, &unavailableError{retryAfter: b.until.Sub(now)}
+	}
+
+	s.tokens = math.Min(s.burst, s.tokens+now.Sub(s.last).Seconds()*s.rate)
+	s.last = now
+
+	wait := time.Duration((1 - s.tokens) / s.rate * float64(time.Second))
+	if wait > schedulerMaxWait {
+		return 0, &unavailableError{retryAfter: wait}
+	}
+
+	s.tokens--
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, nil
+}
+
+// observe updates the state of the scheduler from the response to a
+// request to the endpoint.
+func (s *scheduler) observe(endpoint string, res *http.Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		retryAfter := schedulerDefaultRetryAfter
+		if n, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && n >= 0 {
+			retryAfter = time.Duration(n) * time.Second
+		}
+		s.blocked = time.Now().Add(retryAfter)
+		return &unavailableError{retryAfter: retryAfter}
+	case res.StatusCode >= 500:
+		now := time.Now()
+
+		// Forget endpoints that haven't failed in a while so the map
+		// doesn't grow with every URL that has failed once.
+		for e, b := range s.backoffs {
+			if now.Sub(b.until) > schedulerMaxBackoff {
+				delete(s.backoffs, e)
+			}
+		}
+
+		b, ok := s.backoffs[endpoint]
+		if !ok {
+			b = &schedulerBackoff{}
+			s.backoffs[endpoint] = b
+		}
+		backoff := schedulerMinBackoff << b.failures
+		if backoff > schedulerMaxBackoff || backoff <= 0 {
+			backoff = schedulerMaxBackoff
+		} else {
+			b.failures++
+		}
+		b.until = now.Add(backoff)
+		return &unavailableError{retryAfter: backoff}
+	}
+
+	delete(s.backoffs, endpoint)
+	return nil
+}
+
+// RoundTrip schedules and sends the request. Rate limited and failed
+// requests are returned as an unavailableError.
+func (s *scheduler) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := schedulerEndpoint(req)
+	wait, err := s.reserve(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+
+	res, err := s.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.observe(endpoint, res); err != nil {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// spotifyContext returns a context that makes the oauth2 package send its
+// requests through the scheduler.
+func (a *app) spotifyContext() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, a.httpClient)
+}
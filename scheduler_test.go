@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerTokenBucket(t *testing.T) {
+	s := newScheduler(2)
+	for i := 0; i < 2; i++ {
+		if wait, err := s.reserve("endpoint"); wait != 0 || err != nil {
+			t.Fatalf("got %s and %v for request %d within the burst", wait, err, i)
+		}
+	}
+	if wait, err := s.reserve("endpoint"); err != nil || wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("got %s and %v after the burst, want a wait of at most 500ms", wait, err)
+	}
+
+	// Requests that would wait too long are rejected.
+	s = newScheduler(0.1)
+	if _, err := s.reserve("endpoint"); err == nil {
+		t.Error("request that would wait for 9s was scheduled")
+	} else if d, ok := isUnavailable(err); !ok || d <= schedulerMaxWait {
+		t.Errorf("got %v, want to retry after more than %s", err, schedulerMaxWait)
+	}
+}
+
+// newSchedulerTestServer returns a server that responds with the status
+// stored for the path, or 200, and counts the requests.
+func newSchedulerTestServer(t *testing.T, status *sync.Map) (*httptest.Server, *int32) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if code, ok := status.Load(r.URL.Path); ok {
+			if code == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "30")
+			}
+			w.WriteHeader(code.(int))
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &requests
+}
+
+func TestSchedulerRateLimited(t *testing.T) {
+	var status sync.Map
+	status.Store("/limited", http.StatusTooManyRequests)
+	ts, requests := newSchedulerTestServer(t, &status)
+	c := &http.Client{Transport: newScheduler(100)}
+
+	_, err := c.Get(ts.URL + "/limited")
+	if d, ok := isUnavailable(err); !ok || d != 30*time.Second {
+		t.Fatalf("got %v, want to retry after 30s", err)
+	}
+
+	// Rate limits apply to all endpoints.
+	if _, err := c.Get(ts.URL + "/other"); err == nil {
+		t.Error("request was sent while rate limited")
+	}
+	if atomic.LoadInt32(requests) != 1 {
+		t.Errorf("sent %d requests, want 1", *requests)
+	}
+}
+
+func TestSchedulerServerErrors(t *testing.T) {
+	var status sync.Map
+	status.Store("/failing", http.StatusBadGateway)
+	ts, requests := newSchedulerTestServer(t, &status)
+	s := newScheduler(100)
+	c := &http.Client{Transport: s}
+
+	_, err := c.Get(ts.URL + "/failing")
+	if d, ok := isUnavailable(err); !ok || d != schedulerMinBackoff {
+		t.Fatalf("got %v, want to retry after %s", err, schedulerMinBackoff)
+	}
+
+	// The failing endpoint is backed off, other endpoints aren't.
+	if _, err := c.Get(ts.URL + "/failing"); err == nil {
+		t.Error("request was sent to the failing endpoint while backing off")
+	}
+	res, err := c.Get(ts.URL + "/other")
+	if err != nil {
+		t.Fatalf("request to another endpoint failed: %v", err)
+	}
+	res.Body.Close()
+	if atomic.LoadInt32(requests) != 2 {
+		t.Errorf("sent %d requests, want 2", *requests)
+	}
+
+	// The back off doubles for each consecutive error.
+	endpoint := schedulerEndpoint(httptest.NewRequest(http.MethodGet, ts.URL+"/failing", nil))
+	s.backoffs[endpoint].until = time.Now()
+	_, err = c.Get(ts.URL + "/failing")
+	if d, ok := isUnavailable(err); !ok || d != 2*schedulerMinBackoff {
+		t.Fatalf("got %v, want to retry after %s", err, 2*schedulerMinBackoff)
+	}
+
+	// A successful response resets it.
+	status.Delete("/failing")
+	s.backoffs[endpoint].until = time.Now()
+	res, err = c.Get(ts.URL + "/failing")
+	if err != nil {
+		t.Fatalf("request failed after the back off: %v", err)
+	}
+	res.Body.Close()
+	if _, ok := s.backoffs[endpoint]; ok {
+		t.Error("back off wasn't reset by a successful response")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Collection of Spotify scopes that lyssnar requests.
+const (
+	scopeCurrentlyPlaying = "user-read-currently-playing"
+	scopeRecentlyPlayed   = "user-read-recently-played"
+	scopePlaybackState    = "user-read-playback-state"
+)
+
+// feature describes a lyssnar feature that requires a Spotify scope.
+type feature struct {
+	// The scope that the user must have granted.
+	scope string
+
+	// A short description of the feature that is shown to the user when
+	// the scope is missing, e.g. "show your recently played tracks".
+	description string
+}
+
+// Collection of features that are gated on scopes.
+var (
+	featureCurrentlyPlaying = &feature{scope: scopeCurrentlyPlaying, description: "show what you're currently listening to"}
+	featureRecentlyPlayed   = &feature{scope: scopeRecentlyPlayed, description: "show your recently played tracks"}
+	featurePlaybackState    = &feature{scope: scopePlaybackState, description: "show the device you're listening on and hide private sessions"}
+)
+
+// features contains all the features, in the order they're listed in.
+var features = []*feature{
+	featureCurrentlyPlaying,
+	featureRecentlyPlayed,
+	featurePlaybackState,
+}
+
+// scopes returns the scopes that are required by all features.
+func scopes() []string {
+	var s []string
+	for _, f := range features {
+		s = append(s, f.scope)
+	}
+	return s
+}
+
+// hasScope returns true if the given scope has been granted for the token.
+func hasScope(t *oauth2.Token, scope string) bool {
+	for _, g := range strings.Fields(tokenScope(t)) {
+		if g == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled returns true if the feature is enabled for the given token.
+func (f *feature) enabled(t *oauth2.Token) bool {
+	return hasScope(t, f.scope)
+}
+
+// missingFeatures returns the features that can't be used with the given
+// token since the user hasn't granted the scopes they require.
+func missingFeatures(t *oauth2.Token) []*feature {
+	var missing []*feature
+	for _, f := range features {
+		if !f.enabled(t) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// missingFeatureDescriptions returns the descriptions of the features that
+// can't be used with the given token.
+func missingFeatureDescriptions(t *oauth2.Token) []string {
+	var d []string
+	for _, f := range missingFeatures(t) {
+		d = append(d, f.description)
+	}
+	return d
+}
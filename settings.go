@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the user has to confirm the settings that were passed to
+// /authorize.
+const settingsLifetime = 10 * time.Minute
+
+// pendingSettings are the settings that were passed to /authorize. Anyone
+// can craft an authorization link and Spotify doesn't ask users that have
+// already authorized lyssnar again, so the settings are only stored once
+// the user has confirmed them.
+type pendingSettings struct {
+	// The user id that the settings belong to.
+	UserID string
+
+	// The default short format, nil leaves the stored format as it is.
+	ShortFormat *string
+
+	// The origins that are allowed to embed the user's widget, nil leaves
+	// the stored origins as they are.
+	FrameAncestors *string
+
+	// When the settings can no longer be confirmed.
+	ExpiresAt time.Time
+}
+
+// settingsToken returns a signed token that contains the given settings,
+// it's posted back to /settings when the user confirms them.
+func (a *app) settingsToken(p *pendingSettings) string {
+	value := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(p.UserID)),
+		strconv.FormatInt(p.ExpiresAt.Unix(), 10),
+		encodeOptional("f", p.ShortFormat),
+		encodeOptional("a", p.FrameAncestors),
+	}, ".")
+
+	// The value is prefixed before it's signed so that a state cookie
+	// can't be passed off as a settings token.
+	return value + "." + a.sign("settings."+value)
+}
+
+// verifySettingsToken verifies the signature and the expiry of the given
+// token and returns the settings in it.
+func (a *app) verifySettingsToken(token string) (*pendingSettings, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, errors.New("settings token is malformed")
+	}
+
+	value := strings.Join(parts[:4], ".")
+	if !hmac.Equal([]byte(parts[4]), []byte(a.sign("settings."+value))) {
+		return nil, errors.New("settings token has an invalid signature")
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("settings token has an invalid user id: %v", err)
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("settings token has an invalid expiry: %v", err)
+	}
+
+	p := &pendingSettings{UserID: string(id), ExpiresAt: time.Unix(expires, 0)}
+	if p.ShortFormat, err = decodeOptional("f", parts[2]); err != nil {
+		return nil, fmt.Errorf("settings token has an invalid short format: %v", err)
+	}
+	if p.FrameAncestors, err = decodeOptional("a", parts[3]); err != nil {
+		return nil, fmt.Errorf("settings token has invalid frame ancestors: %v", err)
+	}
+	if time.Now().After(p.ExpiresAt) {
+		return nil, errors.New("settings token has expired")
+	}
+
+	return p, nil
+}
+
+// describeSettings returns the settings as a list of names and values that
+// are shown to the user before they're confirmed.
+func describeSettings(p *pendingSettings) []map[string]string {
+	var out []map[string]string
+	if p.ShortFormat != nil {
+		v := *p.ShortFormat
+		if v == "" {
+			v = "the default format"
+		}
+		out = append(out, map[string]string{"name": "Short API format", "value": v})
+	}
+	if p.FrameAncestors != nil {
+		v := *p.FrameAncestors
+		if v == "" {
+			v = "any site"
+		}
+		out = append(out, map[string]string{"name": "Sites that may embed your widget", "value": v})
+	}
+	return out
+}
+
+// settings stores the settings that the user confirmed on the page that is
+// shown after authorizing. The settings are taken from the signed token in
+// the form, never from the request itself.
+func (a *app) settings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		tError.Execute(w, map[string]string{"header": ":-(", "message": "Settings can only be changed from the page that is shown after authorizing."})
+		return
+	}
+
+	p, err := a.verifySettingsToken(r.FormValue("token"))
+	if err != nil {
+		log.Printf("invalid settings token: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		tError.Execute(w, map[string]string{"header": ":-(", "message": "The settings are invalid or have expired, authorize again to change them."})
+		return
+	}
+
+	if a.getToken(p.UserID) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		tError.Execute(w, map[string]string{"header": ":-(", "message": "The account is not authorized on lyssnar.com yet"})
+		return
+	}
+
+	if p.ShortFormat != nil {
+		if err := a.storeShortFormat(p.UserID, *p.ShortFormat); err != nil {
+			log.Printf("can't store short format for %s: %v", p.UserID, err)
+			tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
+			return
+		}
+	}
+	if p.FrameAncestors != nil {
+		if err := a.storeFrameAncestors(p.UserID, *p.FrameAncestors); err != nil {
+			log.Printf("can't store frame ancestors for %s: %v", p.UserID, err)
+			tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
+			return
+		}
+	}
+
+	tAuthorized.Execute(w, map[string]interface{}{"id": p.UserID, "saved": true})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// settingsTokenPattern finds the settings token in the confirmation form.
+var settingsTokenPattern = regexp.MustCompile(`name="token" value="([^"]+)"`)
+
+func TestVerifySettingsToken(t *testing.T) {
+	a := &app{sessionKey: newSessionKey("")}
+
+	format := "{{.Title}}"
+	p := &pendingSettings{UserID: "alice", ShortFormat: &format, ExpiresAt: time.Now().Add(settingsLifetime)}
+	token := a.settingsToken(p)
+
+	got, err := a.verifySettingsToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != "alice" || got.ShortFormat == nil || *got.ShortFormat != format || got.FrameAncestors != nil {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+
+	parts := strings.Split(token, ".")
+	tests := map[string]string{
+		"signature": token + "x",
+		"user":      strings.Join(append([]string{"Ym9i"}, parts[1:]...), "."),
+		"malformed": strings.Join(parts[:4], "."),
+		"expired":   a.settingsToken(&pendingSettings{UserID: "alice", ExpiresAt: time.Now().Add(-time.Second)}),
+		"other key": (&app{sessionKey: newSessionKey("")}).settingsToken(p),
+	}
+
+	for name, token := range tests {
+		if _, err := a.verifySettingsToken(token); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestSettingsConfirmation(t *testing.T) {
+	a := newTestApp(t)
+
+	w := authorizeTestUser(t, a, url.Values{"short_format": {"{{.Title}}"}, "frame_ancestors": {"https://example.com"}}.Encode())
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Error("the confirmation page can be framed")
+	}
+
+	// Nothing is stored until the user confirms.
+	if f, _ := a.getShortFormat("alice"); f != "" {
+		t.Errorf("short format %q was stored before it was confirmed", f)
+	}
+
+	m := settingsTokenPattern.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("no settings token in %s", w.Body)
+	}
+
+	post := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(a, r)
+	}
+
+	if w := serve(a, httptest.NewRequest(http.MethodGet, "/settings?token="+url.QueryEscape(m[1]), nil)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /settings returned %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := post(m[1] + "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("tampered token returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := post(m[1]); w.Code != http.StatusOK {
+		t.Fatalf("POST /settings returned %d: %s", w.Code, w.Body)
+	}
+
+	if f, _ := a.getShortFormat("alice"); f != "{{.Title}}" {
+		t.Errorf("got short format %q, want %q", f, "{{.Title}}")
+	}
+	if f, _ := a.getFrameAncestors("alice"); f != "https://example.com" {
+		t.Errorf("got frame ancestors %q, want %q", f, "https://example.com")
+	}
+}
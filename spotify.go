@@ -2,28 +2,33 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 )
 
 // getUserObject fetches the user profile from the Spotify API.
-func (a *app) getUserObject(at, rt string) (*UserObject, error) {
+func (a *app) getUserObject(token *oauth2.Token) (*UserObject, error) {
 	// Allow the code to be retried once, we do this because the access token
 	// might have expired. When this is the case we'll use the refresh token
 	// to acquire a new access token and try again.
 	retry := true
 
-	// Construct the oauth2 token.
-	t := &oauth2.Token{AccessToken: at, RefreshToken: rt}
+	// Copy the token so that we don't modify the given token when we
+	// invalidate it.
+	t := *token
 start:
-	cli := a.conf.Client(oauth2.NoContext, t)
-	res, err := cli.Get("https://api.spotify.com/v1/me")
+	cli := a.conf.Client(a.spotifyContext(), &t)
+	res, err := cli.Get(a.apiURL + "/v1/me")
 	if err != nil {
-		log.Printf("failed to get https://api.spotify.com/v1/me, error: %s", err.Error())
+		log.Printf("failed to get %s/v1/me, error: %s", a.apiURL, err.Error())
 		return nil, err
 	}
 	defer res.Body.Close()
@@ -51,67 +56,155 @@ start:
 	return uo, nil
 }
 
-// getCurrentlyPlaying fetches the currently playing song for the user that
-// the token belongs to from the Spotify API.
-func (a *app) getCurrentlyPlayingObject(id, at, rt string) (*CurrentlyPlayingObject, error) {
+// getUserResource performs a GET request for the given path of the Spotify
+// API on behalf of the given user id. The status code and the body of the
+// response are returned.
+func (a *app) getUserResource(id, path string) (int, []byte, error) {
+	return a.getUserResourceFor(id, func(*oauth2.Token) string { return path })
+}
+
+// getUserResourceFor is like getUserResource, but the path is returned by
+// the given function which is passed the token that the request is made
+// with, so that the path can depend on the scopes that have been granted.
+func (a *app) getUserResourceFor(id string, path func(t *oauth2.Token) string) (int, []byte, error) {
 	// Allow the code to be retried once, we do this because the access token
-	// might have expired. When this is the case we'll use the refresh token
-	// to acquire a new access token and try again.
+	// might have been revoked before it expired. When this is the case we'll
+	// invalidate it so that a new access token is acquired and try again.
 	retry := true
 
-	// Construct the oauth2 token.
-	t := &oauth2.Token{AccessToken: at, RefreshToken: rt}
 start:
-	cli := a.conf.Client(oauth2.NoContext, t)
-	res, err := cli.Get("https://api.spotify.com/v1/me/player/currently-playing?additional_types=track,episode")
+	// Get a valid token for the user, the token source refreshes the
+	// token and stores the new one if it has expired.
+	t, err := a.tokenSource(id).Token()
+	if err == errNotAuthorized {
+		return 0, nil, err
+	}
 	if err != nil {
-		// Let's delete the user if the token has been revoked, we'll
-		// return a nil, nil instead of an error here to handle the
-		// results more gracefully, the next time the user's page is
-		// accessed it will show as not registered.
+		// Let's delete the user if the token has been revoked, the
+		// user will show as not registered from now on.
 		if strings.Contains(err.Error(), "Refresh token revoked") {
 			a.deleteUser(id)
-			return nil, nil
+			return 0, nil, errNotAuthorized
 		}
 
-		log.Printf("failed to get https://api.spotify.com/v1/me/player/currently-playing, error: %s", err.Error())
-		return nil, err
+		log.Printf("failed to get token for %s, error: %s", id, err.Error())
+		return 0, nil, err
 	}
-	defer res.Body.Close()
 
-	// The API returns a No Content status code if the user isn't playing
-	// anything. If that's the case we'll just return nil.
-	if res.StatusCode == http.StatusNoContent {
-		return nil, nil
+	p := path(t)
+	cli := oauth2.NewClient(a.spotifyContext(), oauth2.StaticTokenSource(t))
+	res, err := cli.Get(a.apiURL + p)
+	if err != nil {
+		log.Printf("failed to get %s%s, error: %s", a.apiURL, p, err.Error())
+		return 0, nil, err
 	}
+	defer res.Body.Close()
 
 	d, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		log.Printf("failed reading res body: %s", err.Error())
+		return 0, nil, err
+	}
+
+	// The token has probably been revoked, invalidate the access token
+	// and try again.
+	if res.StatusCode == http.StatusUnauthorized && retry {
+		retry = false
+		if err := a.invalidateToken(id, t.AccessToken); err != nil {
+			return 0, nil, err
+		}
+		goto start
+	}
+
+	return res.StatusCode, d, nil
+}
+
+// getCurrentlyPlaying fetches the currently playing song for the given
+// user id from the Spotify API. The full playback state, which includes
+// the device, is fetched if the user has granted access to it. Items that
+// are played in a private session are never returned.
+func (a *app) getCurrentlyPlayingObject(id string) (*CurrentlyPlayingObject, error) {
+	status, d, err := a.getUserResourceFor(id, func(t *oauth2.Token) string {
+		if featurePlaybackState.enabled(t) {
+			return "/v1/me/player?additional_types=track,episode"
+		}
+		return "/v1/me/player/currently-playing?additional_types=track,episode"
+	})
+	if err != nil {
 		return nil, err
 	}
 
+	// The API returns a No Content status code if the user isn't playing
+	// anything. If that's the case we'll just return nil.
+	if status == http.StatusNoContent {
+		a.rememberCurrentlyPlayingObject(id, nil)
+		return nil, nil
+	}
+
 	cpo := &CurrentlyPlayingObject{}
 	if err := json.Unmarshal(d, cpo); err != nil {
 		log.Printf("failed to unmarshal json in getCurrentlyPlaying: %s, %s", err.Error(), string(d))
 		return nil, err
 	}
 
-	// The token has probably expired, invalidate the access token
-	// and try again.
-	if cpo.Error != nil && cpo.Error.Status == 401 && retry {
-		retry = false
-		t.AccessToken = ""
-		goto start
+	// Any error from Spotify is returned as an error rather than as a
+	// currently playing object.
+	if cpo.Error != nil {
+		return nil, fmt.Errorf("spotify returned %d: %s", cpo.Error.Status, cpo.Error.Message)
 	}
 
-	// Check whether the token used in the request is the same as the
-	// token passed to the method. If it changed we'll update the
-	// database with the used (new) token.
-	used, _ := cli.Transport.(*oauth2.Transport).Source.Token()
-	if used.AccessToken != at {
-		a.updateAccessToken(id, used.AccessToken)
+	// Treat private sessions as if the user isn't playing anything, they
+	// are neither shown nor recorded.
+	if cpo.Device != nil && cpo.Device.IsPrivateSession {
+		a.rememberCurrentlyPlayingObject(id, nil)
+		return nil, nil
 	}
 
+	a.rememberCurrentlyPlayingObject(id, cpo)
 	return cpo, nil
 }
+
+// getRecentlyPlayedObject fetches the tracks the given user id has played
+// recently from the Spotify API. At most limit tracks are returned, before
+// and after are optional unix timestamps in milliseconds, only one of them
+// can be set.
+func (a *app) getRecentlyPlayedObject(id string, limit int, before, after string) (*RecentlyPlayedObject, error) {
+	q := url.Values{}
+	q.Set("limit", strconv.Itoa(limit))
+	if before != "" {
+		q.Set("before", before)
+	}
+	if after != "" {
+		q.Set("after", after)
+	}
+
+	_, d, err := a.getUserResource(id, "/v1/me/player/recently-played?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	rpo := &RecentlyPlayedObject{}
+	if err := json.Unmarshal(d, rpo); err != nil {
+		log.Printf("failed to unmarshal json in getRecentlyPlayed: %s, %s", err.Error(), string(d))
+		return nil, err
+	}
+
+	if rpo.Error != nil {
+		return nil, fmt.Errorf("spotify returned %d: %s", rpo.Error.Status, rpo.Error.Message)
+	}
+
+	return rpo, nil
+}
+
+// rememberCurrentlyPlayingObject stores the object as the last known
+// object for the given user id, so that it can be served if Spotify is
+// unavailable later on, and records the item in the listening history.
+func (a *app) rememberCurrentlyPlayingObject(id string, cpo *CurrentlyPlayingObject) {
+	if err := a.storeLastKnown(id, cpo); err != nil {
+		log.Printf("failed to store last known object for %s: %s", id, err.Error())
+	}
+
+	if err := a.recordPlay(id, cpo, time.Now()); err != nil {
+		log.Printf("failed to record play for %s: %s", id, err.Error())
+	}
+}
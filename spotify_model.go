@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 // AlbumObjectSimplified contains the simplified album object.
 // https://developer.spotify.com/documentation/web-api/reference/object-model/#album-object-simplified
 type AlbumObjectSimplified struct {
@@ -99,6 +101,39 @@ type ContextObject struct {
 	URI string `json:"uri"`
 }
 
+// ContextMetadataObject contains the fields that are shared by the
+// playlist, album, artist and show objects which a context can refer to,
+// together with the fields that tell who made it.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#playlist-object-full
+type ContextMetadataObject struct {
+	// An Error Object. Can be null.
+	Error *ErrorObject `json:"error,omitempty"`
+
+	// External URLs for this object.
+	ExternalURLs map[string]string `json:"external_urls"`
+
+	// The Spotify ID for the object.
+	ID string `json:"id"`
+
+	// Images for the object in various sizes, widest first.
+	Images []ImageObject `json:"images"`
+
+	// The name of the object.
+	Name string `json:"name"`
+
+	// The object type: “playlist”, “album”, “artist” or “show”.
+	Type string `json:"type"`
+
+	// The user who owns the playlist. Only set for playlists.
+	Owner *UserObject `json:"owner,omitempty"`
+
+	// The artists of the album. Only set for albums.
+	Artists []ArtistObjectSimplified `json:"artists,omitempty"`
+
+	// The publisher of the show. Only set for shows.
+	Publisher string `json:"publisher,omitempty"`
+}
+
 // CurrentlyPlayingObject contains a combination of previously defined
 // objects.
 type CurrentlyPlayingObject struct {
@@ -117,12 +152,140 @@ type CurrentlyPlayingObject struct {
 	// If something is currently playing.
 	IsPlaying bool `json:"is_playing,omitempty"`
 
-	// The currently playing track. Can be null.
-	Item *TrackObjectFull `json:"item,omitempty"`
+	// The currently playing track. Can be null. The item is decoded into
+	// Item, Episode or Chapter depending on its type, at most one of them
+	// is set. None of them are set for ads and unknown items.
+	Item *TrackObjectFull `json:"-"`
+
+	// The currently playing episode. Can be null.
+	Episode *EpisodeObject `json:"-"`
+
+	// The currently playing audiobook chapter. Can be null.
+	Chapter *ChapterObject `json:"-"`
 
 	// The object type of the currently playing item. Can be one of track,
 	// episode, ad or unknown.
 	CurrentlyPlayingType string `json:"currently_playing_type,omitempty"`
+
+	// The device that is currently active. Only set when the playback
+	// state is fetched.
+	Device *DeviceObject `json:"device,omitempty"`
+
+	// If shuffle is on or off. Only set when the playback state is
+	// fetched.
+	ShuffleState *bool `json:"shuffle_state,omitempty"`
+
+	// The repeat state, off, track or context. Only set when the
+	// playback state is fetched.
+	RepeatState string `json:"repeat_state,omitempty"`
+}
+
+// currentlyPlayingObjectJSON is used to encode and decode a currently
+// playing object with the item as raw JSON.
+type currentlyPlayingObjectJSON struct {
+	*currentlyPlayingObjectFields
+
+	Item json.RawMessage `json:"item,omitempty"`
+}
+
+// currentlyPlayingObjectFields has the same fields as the currently playing
+// object, but not its methods.
+type currentlyPlayingObjectFields CurrentlyPlayingObject
+
+// UnmarshalJSON decodes the item into a track, an episode or a chapter
+// depending on its type. The type of the item is used if it's set since
+// Spotify reports audiobook chapters as episodes, currently_playing_type
+// is used otherwise.
+func (c *CurrentlyPlayingObject) UnmarshalJSON(data []byte) error {
+	v := &currentlyPlayingObjectJSON{currentlyPlayingObjectFields: (*currentlyPlayingObjectFields)(c)}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+
+	c.Item, c.Episode, c.Chapter = nil, nil, nil
+	if len(v.Item) == 0 || string(v.Item) == "null" {
+		return nil
+	}
+
+	var item struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(v.Item, &item); err != nil {
+		return err
+	}
+	if item.Type == "" {
+		item.Type = c.CurrentlyPlayingType
+	}
+
+	switch item.Type {
+	case "track":
+		c.Item = &TrackObjectFull{}
+		return json.Unmarshal(v.Item, c.Item)
+	case "episode":
+		c.Episode = &EpisodeObject{}
+		return json.Unmarshal(v.Item, c.Episode)
+	case "chapter":
+		c.Chapter = &ChapterObject{}
+		return json.Unmarshal(v.Item, c.Chapter)
+	}
+
+	// Ads and unknown items can't be described, drop them.
+	return nil
+}
+
+// MarshalJSON encodes the track, episode or chapter as the item.
+func (c *CurrentlyPlayingObject) MarshalJSON() ([]byte, error) {
+	v := &currentlyPlayingObjectJSON{currentlyPlayingObjectFields: (*currentlyPlayingObjectFields)(c)}
+
+	var err error
+	switch {
+	case c.Item != nil:
+		v.Item, err = json.Marshal(c.Item)
+	case c.Episode != nil:
+		v.Item, err = json.Marshal(c.Episode)
+	case c.Chapter != nil:
+		v.Item, err = json.Marshal(c.Chapter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// DeviceObject contains the device object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#device-object
+type DeviceObject struct {
+	// The device ID. Can be null.
+	ID *string `json:"id,omitempty"`
+
+	// If this device is the currently active device.
+	IsActive bool `json:"is_active"`
+
+	// If this device is currently in a private session.
+	IsPrivateSession bool `json:"is_private_session"`
+
+	// Whether controlling this device is restricted.
+	IsRestricted bool `json:"is_restricted"`
+
+	// The name of the device, e.g. "Kitchen speaker".
+	Name string `json:"name"`
+
+	// Device type, such as "computer", "smartphone" or "speaker".
+	Type string `json:"type"`
+
+	// The current volume in percent. Can be null.
+	VolumePercent *int `json:"volume_percent,omitempty"`
+}
+
+// CursorObject contains the cursors used to find the next set of items.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#cursor-object
+type CursorObject struct {
+	// The cursor to use as key to find the next page of items.
+	After string `json:"after,omitempty"`
+
+	// The cursor to use as key to find the previous page of items.
+	Before string `json:"before,omitempty"`
 }
 
 // ErrorObject contains the error object.
@@ -180,6 +343,46 @@ type LinkedTrackObject struct {
 	URI string `json:"uri"`
 }
 
+// PlayHistoryObject contains the play history object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#play-history-object
+type PlayHistoryObject struct {
+	// The track the user listened to.
+	Track TrackObjectFull `json:"track"`
+
+	// The date and time the track was played, in ISO 8601 format.
+	PlayedAt string `json:"played_at"`
+
+	// The context the track was played from. Can be null.
+	Context *ContextObject `json:"context"`
+}
+
+// RecentlyPlayedObject contains a cursor-based paging object of play
+// history objects.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#cursor-based-paging-object
+type RecentlyPlayedObject struct {
+	// An Error Object. Can be null.
+	Error *ErrorObject `json:"error,omitempty"`
+
+	// A link to the Web API endpoint returning the full result of the
+	// request.
+	HREF string `json:"href"`
+
+	// The requested data.
+	Items []PlayHistoryObject `json:"items"`
+
+	// The maximum number of items in the response.
+	Limit int `json:"limit"`
+
+	// URL to the next page of items. Can be null.
+	Next *string `json:"next"`
+
+	// The cursors used to find the next set of items. Can be null.
+	Cursors *CursorObject `json:"cursors"`
+
+	// The total number of items available to return.
+	Total int `json:"total,omitempty"`
+}
+
 // TrackObjectFull contains the full track object.
 // https://developer.spotify.com/documentation/web-api/reference/object-model/#track-object-full
 type TrackObjectFull struct {
@@ -261,31 +464,176 @@ type TrackObjectFull struct {
 	// number is the number on the specified disc.
 	TrackNumber int `json:"track_number"`
 
-	// The object type: “track” or "episode".
+	// The object type: “track”.
 	Type string `json:"type"`
 
 	// The Spotify URI for the track.
 	URI string `json:"uri"`
 
-	// Whether or not the track is from a local file.
+	// Whether or not the track is from a local file. Local files have no
+	// ID, album art or external URLs.
 	IsLocal bool `json:"is_local"`
-
-	Show Show `json:"show"`
 }
 
-// Show contains information about a show, which can be a podcast.
-type Show struct {
-	// External URLs for this context.
+// EpisodeObject contains the full episode object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#episode-object-full
+type EpisodeObject struct {
+	// A link to a 30 second preview (MP3 format) of the episode. Can be
+	// null.
+	AudioPreviewURL *string `json:"audio_preview_url"`
+
+	// A description of the episode, HTML tags are stripped.
+	Description string `json:"description"`
+
+	// A description of the episode, may contain HTML tags.
+	HTMLDescription string `json:"html_description,omitempty"`
+
+	// The episode length in milliseconds.
+	DurationMS int `json:"duration_ms"`
+
+	// Whether or not the episode has explicit content.
+	Explicit bool `json:"explicit"`
+
+	// External URLs for this episode.
 	ExternalURLs map[string]string `json:"external_urls"`
 
-	// Name of the show.
+	// A link to the Web API endpoint providing full details of the
+	// episode.
+	HREF string `json:"href"`
+
+	// The Spotify ID for the episode.
+	ID string `json:"id"`
+
+	// The cover art for the episode in various sizes, widest first.
+	Images []ImageObject `json:"images"`
+
+	// True if the episode is playable in the given market.
+	IsPlayable bool `json:"is_playable"`
+
+	// The name of the episode.
 	Name string `json:"name"`
 
+	// The date the episode was first released, for example
+	// "1981-12-15". Depending on the precision, it might be shown as
+	// "1981" or "1981-12".
+	ReleaseDate string `json:"release_date"`
+
+	// The precision with which release_date value is known: year, month
+	// or day.
+	ReleaseDatePrecision string `json:"release_date_precision"`
+
+	// The show on which the episode belongs.
+	Show ShowObject `json:"show"`
+
+	// The object type: “episode”.
+	Type string `json:"type"`
+
+	// The Spotify URI for the episode.
+	URI string `json:"uri"`
+}
+
+// ShowObject contains the simplified show object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#show-object-simplified
+type ShowObject struct {
+	// A description of the show.
+	Description string `json:"description,omitempty"`
+
+	// External URLs for this show.
+	ExternalURLs map[string]string `json:"external_urls"`
+
+	// A link to the Web API endpoint providing full details of the show.
+	HREF string `json:"href,omitempty"`
+
+	// The Spotify ID for the show.
+	ID string `json:"id"`
+
 	// The cover art for the show in various sizes, widest first.
 	Images []ImageObject `json:"images"`
 
-	// ID of the show.
+	// The name of the show.
+	Name string `json:"name"`
+
+	// The publisher of the show.
+	Publisher string `json:"publisher,omitempty"`
+
+	// The object type: “show”.
+	Type string `json:"type,omitempty"`
+
+	// The Spotify URI for the show.
+	URI string `json:"uri,omitempty"`
+}
+
+// ChapterObject contains the full audiobook chapter object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#chapter-object-full
+type ChapterObject struct {
+	// The audiobook on which the chapter belongs.
+	Audiobook AudiobookObject `json:"audiobook"`
+
+	// The number of the chapter.
+	ChapterNumber int `json:"chapter_number"`
+
+	// A description of the chapter, HTML tags are stripped.
+	Description string `json:"description"`
+
+	// The chapter length in milliseconds.
+	DurationMS int `json:"duration_ms"`
+
+	// External URLs for this chapter.
+	ExternalURLs map[string]string `json:"external_urls"`
+
+	// A link to the Web API endpoint providing full details of the
+	// chapter.
+	HREF string `json:"href"`
+
+	// The Spotify ID for the chapter.
+	ID string `json:"id"`
+
+	// The cover art for the chapter in various sizes, widest first.
+	Images []ImageObject `json:"images"`
+
+	// The name of the chapter.
+	Name string `json:"name"`
+
+	// The date the chapter was first released.
+	ReleaseDate string `json:"release_date"`
+
+	// The object type: “chapter”.
+	Type string `json:"type"`
+
+	// The Spotify URI for the chapter.
+	URI string `json:"uri"`
+}
+
+// AudiobookObject contains the simplified audiobook object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#audiobook-object-simplified
+type AudiobookObject struct {
+	// The authors of the audiobook.
+	Authors []AuthorObject `json:"authors"`
+
+	// External URLs for this audiobook.
+	ExternalURLs map[string]string `json:"external_urls"`
+
+	// The Spotify ID for the audiobook.
 	ID string `json:"id"`
+
+	// The cover art for the audiobook in various sizes, widest first.
+	Images []ImageObject `json:"images"`
+
+	// The name of the audiobook.
+	Name string `json:"name"`
+
+	// The publisher of the audiobook.
+	Publisher string `json:"publisher,omitempty"`
+
+	// The Spotify URI for the audiobook.
+	URI string `json:"uri"`
+}
+
+// AuthorObject contains the author object.
+// https://developer.spotify.com/documentation/web-api/reference/object-model/#author-object
+type AuthorObject struct {
+	// The name of the author.
+	Name string `json:"name"`
 }
 
 // UserObject contains a partial user object as is fetched without any
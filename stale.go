@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lastKnownTouchInterval is how often the time an unchanged last known
+// object was last seen is written to the database.
+const lastKnownTouchInterval = 30 * time.Second
+
+// lastKnown contains the last currently playing object that was
+// successfully fetched for a user.
+type lastKnown struct {
+	// The currently playing object, nil if the user wasn't playing
+	// anything.
+	cpo *CurrentlyPlayingObject
+
+	// When the object was fetched from Spotify, the progress is
+	// extrapolated from this time.
+	fetchedAt time.Time
+
+	// When Spotify was last seen to return the same object, it's written
+	// at most once every lastKnownTouchInterval.
+	lastSeenAt time.Time
+}
+
+// age returns how long it has been since Spotify was last reached.
+func (lk *lastKnown) age() time.Duration {
+	return time.Since(lk.lastSeenAt)
+}
+
+// lastKnownKeys remembers the key of the last known object that was
+// stored for each user and when it was written, so that it's only written
+// when it changes and touched now and then when it doesn't.
+type lastKnownKeys struct {
+	mu   sync.Mutex
+	keys map[string]lastKnownWrite
+}
+
+// lastKnownWrite is the key of the last known object of a user and when
+// it was last written.
+type lastKnownWrite struct {
+	key       string
+	writtenAt time.Time
+}
+
+// check returns true for changed if the key differs from the one that was
+// stored last for the given user id, and true for touch if it doesn't but
+// the last seen time hasn't been written for lastKnownTouchInterval. The
+// key and the time are remembered if either is true.
+func (k *lastKnownKeys) check(id, key string, now time.Time) (changed, touch bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys == nil {
+		k.keys = make(map[string]lastKnownWrite)
+	}
+	old, ok := k.keys[id]
+	switch {
+	case !ok || old.key != key:
+		changed = true
+	case now.Sub(old.writtenAt) >= lastKnownTouchInterval:
+		touch = true
+	default:
+		return false, false
+	}
+	k.keys[id] = lastKnownWrite{key: key, writtenAt: now}
+	return changed, touch
+}
+
+// forget forgets the key of the given user id, so that the next object is
+// stored regardless of its key.
+func (k *lastKnownKeys) forget(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.keys, id)
+}
+
+// lastKnownKey returns a key that changes whenever the item, the play
+// state or the device changes.
+func lastKnownKey(cpo *CurrentlyPlayingObject) string {
+	if cpo == nil || cpo.Device == nil {
+		return streamKey(cpo)
+	}
+
+	deviceID := ""
+	if cpo.Device.ID != nil {
+		deviceID = *cpo.Device.ID
+	}
+	return streamKey(cpo) + ":" + deviceID + ":" + cpo.Device.Name
+}
+
+// storeLastKnown stores the given currently playing object as the last
+// known object for the given user id. It's only written when the item, the
+// play state or the device has changed since it was stored last, so the
+// fetched time is when the stored state was last seen to change. Otherwise
+// only the last seen time is updated, at most once every
+// lastKnownTouchInterval.
+func (a *app) storeLastKnown(id string, cpo *CurrentlyPlayingObject) error {
+	now := time.Now()
+	changed, touch := a.lastKnownKeys.check(id, lastKnownKey(cpo), now)
+	if touch {
+		_, err := a.db.Exec("UPDATE last_known SET last_seen_at = $1 WHERE user_id = $2", now, id)
+		if err != nil {
+			a.lastKnownKeys.forget(id)
+		}
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(cpo)
+	if err != nil {
+		a.lastKnownKeys.forget(id)
+		return err
+	}
+
+	_, err = a.db.Exec("INSERT INTO last_known (user_id, data, fetched_at, last_seen_at) VALUES($1, $2, $3, $3) ON CONFLICT (user_id) DO UPDATE SET data = excluded.data, fetched_at = excluded.fetched_at, last_seen_at = excluded.last_seen_at", id, string(data), now)
+	if err != nil {
+		a.lastKnownKeys.forget(id)
+	}
+	return err
+}
+
+// getLastKnown returns the last known currently playing object for the
+// given user id, nil is returned if there is none.
+func (a *app) getLastKnown(id string) (*lastKnown, error) {
+	var data string
+	lk := &lastKnown{}
+	err := a.db.QueryRow("SELECT data, fetched_at, last_seen_at FROM last_known WHERE user_id = $1", id).Scan(&data, &lk.fetchedAt, &lk.lastSeenAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(data), &lk.cpo); err != nil {
+		return nil, err
+	}
+
+	return lk, nil
+}
+
+// currentlyPlayingObjectOrStale returns the currently playing object for
+// the given user id and when it was fetched from Spotify. If Spotify can't
+// be reached the last known object is returned instead, together with a
+// non-nil lastKnown that tells how old it is. The error is only returned if
+// there is no last known object.
+func (a *app) currentlyPlayingObjectOrStale(w http.ResponseWriter, id string) (*CurrentlyPlayingObject, time.Time, *lastKnown, error) {
+	cpo, fetchedAt, err := a.cachedCurrentlyPlayingObject(w, id)
+	if err == nil || err == errNotAuthorized {
+		return cpo, fetchedAt, nil, err
+	}
+
+	lk, lerr := a.getLastKnown(id)
+	if lerr != nil {
+		log.Printf("can't get last known object for %s: %v", id, lerr)
+	}
+	if lk == nil {
+		return nil, time.Time{}, nil, err
+	}
+
+	log.Printf("serving stale object for %s: %v", id, err)
+	w.Header().Set("Age", strconv.Itoa(int(lk.age().Seconds())))
+	return lk.cpo, lk.fetchedAt, lk, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreLastKnown(t *testing.T) {
+	a := newTestDB(t)
+
+	store := func(cpo *CurrentlyPlayingObject) *lastKnown {
+		t.Helper()
+		if err := a.storeLastKnown("alice", cpo); err != nil {
+			t.Fatal(err)
+		}
+		lk, err := a.getLastKnown("alice")
+		if err != nil || lk == nil {
+			t.Fatalf("got %v and %v", lk, err)
+		}
+		return lk
+	}
+	// rewind makes it look like the object was written d ago.
+	rewind := func(d time.Duration) {
+		w := a.lastKnownKeys.keys["alice"]
+		w.writtenAt = w.writtenAt.Add(-d)
+		a.lastKnownKeys.keys["alice"] = w
+	}
+
+	first := store(fakeTrack())
+	if !first.lastSeenAt.Equal(first.fetchedAt) {
+		t.Errorf("got last seen at %v, want %v", first.lastSeenAt, first.fetchedAt)
+	}
+
+	// Unchanged objects aren't written within the touch interval.
+	if lk := store(fakeTrack()); !lk.lastSeenAt.Equal(first.lastSeenAt) {
+		t.Errorf("last seen was written within the touch interval")
+	}
+
+	// After that only the last seen time is.
+	rewind(lastKnownTouchInterval)
+	lk := store(fakeTrack())
+	if !lk.fetchedAt.Equal(first.fetchedAt) || !lk.lastSeenAt.After(first.lastSeenAt) {
+		t.Errorf("got fetched at %v and last seen at %v, want %v and after %v", lk.fetchedAt, lk.lastSeenAt, first.fetchedAt, first.lastSeenAt)
+	}
+	if lk.age() >= lastKnownTouchInterval {
+		t.Errorf("got age %s for an object that was just seen", lk.age())
+	}
+
+	// Changes write the object.
+	paused := fakeTrack()
+	paused.IsPlaying = false
+	lk = store(paused)
+	if lk.cpo.IsPlaying || !lk.fetchedAt.After(first.fetchedAt) || !lk.lastSeenAt.Equal(lk.fetchedAt) {
+		t.Errorf("got playing %v, fetched at %v and last seen at %v", lk.cpo.IsPlaying, lk.fetchedAt, lk.lastSeenAt)
+	}
+}
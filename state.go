@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Constants used for the cookie that binds the OAuth state to the browser
+// that initiated the authorization.
+const (
+	stateCookieName = "lyssnar_oauth"
+	stateCookiePath = "/callback"
+	stateLifetime   = 10 * time.Minute
+)
+
+// oauthState contains the data that is stored in the state cookie while
+// the user is authorizing at Spotify.
+type oauthState struct {
+	// The state parameter that is sent to Spotify.
+	State string
+
+	// The PKCE code verifier.
+	Verifier string
+
+	// When the state expires.
+	ExpiresAt time.Time
+
+	// The default short format that the user is asked to confirm once
+	// authorized, an empty string removes it. Nil leaves the stored format
+	// as it is.
+	ShortFormat *string
+
+	// The origins that are allowed to embed the user's widget, separated
+	// by spaces, which the user is asked to confirm once authorized. An
+	// empty string allows all origins and nil leaves the stored origins as
+	// they are.
+	FrameAncestors *string
+}
+
+// newSessionKey returns the key that is used to sign the state cookies. A
+// random key is generated if the given key is empty, which means that any
+// pending authorizations are invalidated on restart.
+func newSessionKey(key string) []byte {
+	if key != "" {
+		return []byte(key)
+	}
+
+	k := make([]byte, 32)
+	rand.Read(k)
+	return k
+}
+
+// sign returns the base64 encoded HMAC of the given value.
+func (a *app) sign(value string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeOptional base64 encodes the given value with the given prefix, so
+// that an empty value can be told apart from no value. An empty string is
+// returned if the value is nil.
+func encodeOptional(prefix string, v *string) string {
+	if v == nil {
+		return ""
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(*v))
+}
+
+// decodeOptional decodes a value that was encoded with encodeOptional, nil
+// is returned if there is no value.
+func decodeOptional(prefix, s string) (*string, error) {
+	if !strings.HasPrefix(s, prefix) {
+		return nil, nil
+	}
+	d, err := base64.RawURLEncoding.DecodeString(s[len(prefix):])
+	if err != nil {
+		return nil, err
+	}
+	v := string(d)
+	return &v, nil
+}
+
+// setStateCookie stores the given state in a signed cookie.
+func (a *app) setStateCookie(w http.ResponseWriter, s *oauthState) {
+	value := strings.Join([]string{s.State, s.Verifier, strconv.FormatInt(s.ExpiresAt.Unix(), 10), encodeOptional("f", s.ShortFormat), encodeOptional("a", s.FrameAncestors)}, ".")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    value + "." + a.sign(value),
+		Path:     stateCookiePath,
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.conf.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearStateCookie removes the state cookie from the browser.
+func (a *app) clearStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Path:     stateCookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.conf.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// verifyState makes sure that the request has a valid state cookie and
+// that the state in the cookie matches the state parameter that Spotify
+// passed back to us. The verified state is returned.
+func (a *app) verifyState(r *http.Request) (*oauthState, error) {
+	c, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return nil, errors.New("state cookie is missing")
+	}
+
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 6 {
+		return nil, errors.New("state cookie is malformed")
+	}
+
+	value := strings.Join(parts[:5], ".")
+	if !hmac.Equal([]byte(parts[5]), []byte(a.sign(value))) {
+		return nil, errors.New("state cookie has an invalid signature")
+	}
+
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("state cookie has an invalid expiry: %v", err)
+	}
+
+	s := &oauthState{State: parts[0], Verifier: parts[1], ExpiresAt: time.Unix(expires, 0)}
+	if s.ShortFormat, err = decodeOptional("f", parts[3]); err != nil {
+		return nil, fmt.Errorf("state cookie has an invalid short format: %v", err)
+	}
+	if s.FrameAncestors, err = decodeOptional("a", parts[4]); err != nil {
+		return nil, fmt.Errorf("state cookie has invalid frame ancestors: %v", err)
+	}
+	if time.Now().After(s.ExpiresAt) {
+		return nil, errors.New("state cookie has expired")
+	}
+
+	if !hmac.Equal([]byte(s.State), []byte(r.FormValue("state"))) {
+		return nil, errors.New("state mismatch")
+	}
+
+	return s, nil
+}
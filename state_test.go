@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// stateRequest returns a callback request with the state cookie that was
+// set for s and the given state parameter.
+func stateRequest(a *app, s *oauthState, state string, tamper func(string) string) *http.Request {
+	w := httptest.NewRecorder()
+	a.setStateCookie(w, s)
+
+	r := httptest.NewRequest(http.MethodGet, "/callback?state="+state, nil)
+	for _, c := range w.Result().Cookies() {
+		if tamper != nil {
+			c.Value = tamper(c.Value)
+		}
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestVerifyState(t *testing.T) {
+	a := &app{conf: &oauth2.Config{}, sessionKey: newSessionKey("")}
+
+	format, ancestors := "{{.Title}}", ""
+	s := &oauthState{State: "state", Verifier: "verifier", ExpiresAt: time.Now().Add(stateLifetime), ShortFormat: &format, FrameAncestors: &ancestors}
+
+	got, err := a.verifyState(stateRequest(a, s, "state", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Verifier != "verifier" || got.ShortFormat == nil || *got.ShortFormat != format || got.FrameAncestors == nil || *got.FrameAncestors != "" {
+		t.Errorf("got %+v, want %+v", got, s)
+	}
+
+	// A state without settings leaves them nil.
+	plain := &oauthState{State: "state", Verifier: "verifier", ExpiresAt: time.Now().Add(stateLifetime)}
+	if got, err := a.verifyState(stateRequest(a, plain, "state", nil)); err != nil || got.ShortFormat != nil || got.FrameAncestors != nil {
+		t.Errorf("got %+v and %v, want no settings", got, err)
+	}
+
+	tests := []struct {
+		name   string
+		s      *oauthState
+		state  string
+		tamper func(string) string
+	}{
+		{"mismatch", s, "other", nil},
+		{"signature", s, "state", func(v string) string { return v + "x" }},
+		{"verifier", s, "state", func(v string) string { return strings.Replace(v, "verifier", "attacker", 1) }},
+		{"malformed", s, "state", func(v string) string { return "state.verifier" }},
+		{"expired", &oauthState{State: "state", Verifier: "verifier", ExpiresAt: time.Now().Add(-time.Second)}, "state", nil},
+	}
+
+	for _, tt := range tests {
+		if _, err := a.verifyState(stateRequest(a, tt.s, tt.state, tt.tamper)); err == nil {
+			t.Errorf("%s: state was accepted", tt.name)
+		}
+	}
+
+	if _, err := a.verifyState(httptest.NewRequest(http.MethodGet, "/callback?state=state", nil)); err == nil {
+		t.Error("missing cookie was accepted")
+	}
+
+	// A cookie signed with another key is rejected.
+	other := &app{conf: &oauth2.Config{}, sessionKey: newSessionKey("")}
+	if _, err := a.verifyState(stateRequest(other, s, "state", nil)); err == nil {
+		t.Error("cookie signed with another key was accepted")
+	}
+}
+
+func TestCallbackWithoutState(t *testing.T) {
+	a := newTestApp(t)
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/callback?code=fake-code-1&state=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/osm/migrator/repository"
+)
+
+// storage describes a database backend that lyssnar can store its data
+// in. The queries in db.go are written so that they work on all backends,
+// what differs between them is how the connection is opened and the
+// schema.
+type storage interface {
+	// driver returns the name of the database/sql driver to use.
+	driver() string
+
+	// dataSource returns the data source name that is passed to the
+	// driver.
+	dataSource() string
+
+	// maxOpenConns returns the maximum number of open connections, zero
+	// means unlimited.
+	maxOpenConns() int
+
+	// migrations returns all the migrations that exists for the
+	// backend.
+	migrations() repository.Source
+}
+
+// newStorage returns the storage backend for the given database URL.
+// sqlite:// URLs are handled by SQLite, e.g. sqlite:///var/lib/lyssnar.db,
+// everything else is passed to PostgreSQL as is so that both URLs and
+// key=value connection strings work.
+func newStorage(dbURL string) (storage, error) {
+	scheme, rest, ok := strings.Cut(dbURL, "://")
+	if !ok || (!strings.EqualFold(scheme, "sqlite") && !strings.EqualFold(scheme, "sqlite3")) {
+		return &postgresStorage{url: dbURL}, nil
+	}
+
+	path, _, _ := strings.Cut(rest, "?")
+	if path == "" {
+		return nil, fmt.Errorf("sqlite database url is missing a path")
+	}
+	return &sqliteStorage{path: path}, nil
+}
+
+// postgresStorage stores the data in a PostgreSQL database.
+type postgresStorage struct {
+	url string
+}
+
+func (s *postgresStorage) driver() string     { return "postgres" }
+func (s *postgresStorage) dataSource() string { return s.url }
+func (s *postgresStorage) maxOpenConns() int  { return 0 }
+
+// migrations returns the PostgreSQL schema.
+func (s *postgresStorage) migrations() repository.Source {
+	return newMigrations(strings.NewReplacer(
+		"{{serial}}", "serial",
+		"{{autoincrement}}", "",
+		"{{timestamp}}", "timestamp with time zone",
+	))
+}
+
+// sqliteStorage stores the data in a SQLite database file.
+type sqliteStorage struct {
+	path string
+}
+
+func (s *sqliteStorage) driver() string { return "sqlite3" }
+
+// dataSource enables WAL and a busy timeout so that the poller and the
+// http handlers don't fail when they're accessing the database at the same
+// time.
+func (s *sqliteStorage) dataSource() string {
+	return "file:" + s.path + "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"
+}
+
+// maxOpenConns is limited to one since SQLite only allows one writer at a
+// time.
+func (s *sqliteStorage) maxOpenConns() int { return 1 }
+
+// migrations returns the SQLite schema. Timestamps are declared as
+// timestamp so that the driver converts them to time.Time when they are
+// scanned.
+func (s *sqliteStorage) migrations() repository.Source {
+	return newMigrations(strings.NewReplacer(
+		"{{serial}}", "integer",
+		"{{autoincrement}}", " AUTOINCREMENT",
+		"{{timestamp}}", "timestamp",
+	))
+}
+
+// migrations is the schema of all backends, the types that differ between
+// the backends are written as placeholders that each backend replaces.
+// {{serial}} and {{autoincrement}} make an auto incrementing primary key
+// and {{timestamp}} is a timestamp with a time zone.
+var migrations = []string{
+	"CREATE TABLE migration (version TEXT NOT NULL PRIMARY KEY);",
+	"CREATE TABLE credential (id text NOT NULL PRIMARY KEY, access_token text NOT NULL, refresh_token text NOT NULL, created_at {{timestamp}} NOT NULL, updated_at {{timestamp}});",
+	"CREATE TABLE play (id {{serial}} NOT NULL PRIMARY KEY{{autoincrement}}, user_id text NOT NULL, item_id text NOT NULL, item_type text NOT NULL, name text NOT NULL, artists text NOT NULL, album text NOT NULL, image_url text NOT NULL, url text NOT NULL, duration_ms integer NOT NULL, progress_ms integer NOT NULL, listened boolean NOT NULL, started_at {{timestamp}} NOT NULL, updated_at {{timestamp}} NOT NULL);",
+	"CREATE INDEX play_user_id_started_at_idx ON play (user_id, started_at);",
+	"ALTER TABLE credential ADD COLUMN key_id text;",
+	"ALTER TABLE credential ADD COLUMN data_key text;",
+	"ALTER TABLE credential ADD COLUMN token_type text;",
+	"ALTER TABLE credential ADD COLUMN expiry {{timestamp}};",
+	"ALTER TABLE credential ADD COLUMN scope text;",
+	"CREATE TABLE last_known (user_id text NOT NULL PRIMARY KEY, data text NOT NULL, fetched_at {{timestamp}} NOT NULL);",
+	"UPDATE credential SET scope = 'user-read-currently-playing' WHERE scope IS NULL OR scope = '';",
+	"CREATE TABLE setting (user_id text NOT NULL PRIMARY KEY, short_format text NOT NULL);",
+	"ALTER TABLE setting ADD COLUMN frame_ancestors text NOT NULL DEFAULT '';",
+	"ALTER TABLE play ADD COLUMN listened_at {{timestamp}};",
+	"UPDATE play SET listened_at = updated_at WHERE listened;",
+	"ALTER TABLE last_known ADD COLUMN last_seen_at {{timestamp}};",
+	"UPDATE last_known SET last_seen_at = fetched_at;",
+}
+
+// newMigrations returns the migrations with the placeholders replaced,
+// they're numbered from 1.
+func newMigrations(types *strings.Replacer) repository.Source {
+	m := make(map[int]string, len(migrations))
+	for i, sql := range migrations {
+		m[i+1] = types.Replace(sql)
+	}
+	return repository.FromMemory(m)
+}
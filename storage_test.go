@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestNewStorage(t *testing.T) {
+	tests := []struct {
+		url    string
+		driver string
+		source string
+	}{
+		{"postgres://@localhost:5432/lyssnar?sslmode=disable", "postgres", "postgres://@localhost:5432/lyssnar?sslmode=disable"},
+		{"postgresql://lyssnar@db/lyssnar", "postgres", "postgresql://lyssnar@db/lyssnar"},
+		{"host=localhost dbname=lyssnar sslmode=disable", "postgres", "host=localhost dbname=lyssnar sslmode=disable"},
+		{"sqlite:///var/lib/lyssnar.db", "sqlite3", "file:/var/lib/lyssnar.db?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"},
+		{"sqlite3://lyssnar.db?mode=rwc", "sqlite3", "file:lyssnar.db?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"},
+		{"SQLite:///tmp/l.db", "sqlite3", "file:/tmp/l.db?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"},
+	}
+
+	for _, tt := range tests {
+		s, err := newStorage(tt.url)
+		if err != nil {
+			t.Errorf("newStorage(%q) returned %v", tt.url, err)
+			continue
+		}
+		if s.driver() != tt.driver || s.dataSource() != tt.source {
+			t.Errorf("newStorage(%q) = %s %q, want %s %q", tt.url, s.driver(), s.dataSource(), tt.driver, tt.source)
+		}
+	}
+
+	for _, u := range []string{"sqlite://", "sqlite://?mode=rwc"} {
+		if _, err := newStorage(u); err == nil {
+			t.Errorf("newStorage(%q) was accepted", u)
+		}
+	}
+}
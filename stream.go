@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants used by the currently playing stream.
+const (
+	// How often a heartbeat comment is sent to the subscribers.
+	streamHeartbeat = 15 * time.Second
+
+	// Number of events that are kept for each watched user so that
+	// clients can resume with Last-Event-ID.
+	streamHistory = 32
+)
+
+// streamEvent is an event that is sent to the subscribers of a stream.
+type streamEvent struct {
+	// The id of the event, it's the unix timestamp in milliseconds of
+	// when the change was observed.
+	ID int64
+
+	// The JSON encoded currently playing object, or null if the user
+	// isn't playing anything.
+	Data []byte
+
+	// Used to detect whether the currently playing object has changed.
+	key string
+}
+
+// streamKey returns a key that changes whenever the track, the play/pause
+// state or the item type changes.
+func streamKey(cpo *CurrentlyPlayingObject) string {
+	if cpo == nil {
+		return ""
+	}
+
+	uri := ""
+	if item := newPlayingItem(cpo); item != nil {
+		uri = item.URI
+	}
+	return fmt.Sprintf("%s:%s:%t", cpo.CurrentlyPlayingType, uri, cpo.IsPlaying)
+}
+
+// streamWatcher polls Spotify for a single user and broadcasts the
+// changes to all subscribers.
+type streamWatcher struct {
+	// The events that have been observed, oldest first.
+	history []*streamEvent
+
+	// The subscribers of the stream.
+	subs map[chan *streamEvent]struct{}
+
+	// Closed when the last subscriber leaves.
+	done chan struct{}
+}
+
+// streamHub keeps track of all watched users. There is only one upstream
+// poll per watched user regardless of the number of subscribers.
+type streamHub struct {
+	a        *app
+	interval time.Duration
+
+	mu       sync.Mutex
+	watchers map[string]*streamWatcher
+}
+
+// newStreamHub returns a stream hub that polls each watched user every
+// interval.
+func newStreamHub(a *app, interval time.Duration) *streamHub {
+	return &streamHub{
+		a:        a,
+		interval: interval,
+		watchers: make(map[string]*streamWatcher),
+	}
+}
+
+// subscribe subscribes to the changes of the given user id. The events
+// that have been observed after lastID are returned together with a
+// channel that receives all future events. The returned function must be
+// called to unsubscribe.
+func (h *streamHub) subscribe(id string, lastID int64) ([]*streamEvent, chan *streamEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w, ok := h.watchers[id]
+	if !ok {
+		w = &streamWatcher{
+			subs: make(map[chan *streamEvent]struct{}),
+			done: make(chan struct{}),
+		}
+		h.watchers[id] = w
+		go h.watch(id, w)
+	}
+
+	// New clients only get the current state, while resuming clients
+	// get all the events they have missed.
+	var missed []*streamEvent
+	if n := len(w.history); lastID == 0 && n > 0 {
+		missed = w.history[n-1:]
+	} else {
+		for _, e := range w.history {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan *streamEvent, streamHistory)
+	w.subs[ch] = struct{}{}
+
+	return missed, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.drop(id, w, ch)
+	}
+}
+
+// drop removes the subscriber and closes its channel, the watcher is
+// stopped when its last subscriber is dropped. It does nothing if the
+// subscriber already has been dropped. h.mu must be held.
+func (h *streamHub) drop(id string, w *streamWatcher, ch chan *streamEvent) {
+	if _, ok := w.subs[ch]; !ok {
+		return
+	}
+
+	delete(w.subs, ch)
+	close(ch)
+	if len(w.subs) == 0 {
+		close(w.done)
+		delete(h.watchers, id)
+	}
+}
+
+// watch polls Spotify for the given user until the last subscriber
+// leaves.
+func (h *streamHub) watch(id string, w *streamWatcher) {
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+
+	for {
+		h.poll(id, w)
+
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// poll fetches the currently playing object and broadcasts it if it has
+// changed since the last poll.
+func (h *streamHub) poll(id string, w *streamWatcher) {
+	cpo, _, err := h.a.cachedCurrentlyPlayingObject(nil, id)
+	if err != nil {
+		log.Printf("stream: can't get currently playing for %s: %v", id, err)
+		return
+	}
+
+	// Spotify errors are not broadcasted, we'll try again on the next
+	// poll.
+	if cpo != nil && cpo.Error != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := streamKey(cpo)
+	if n := len(w.history); n > 0 && w.history[n-1].key == key {
+		return
+	}
+
+	data, _ := json.Marshal(publicCurrentlyPlayingObject(cpo))
+	e := &streamEvent{ID: time.Now().UnixMilli(), Data: data, key: key}
+	if n := len(w.history); n > 0 && e.ID <= w.history[n-1].ID {
+		e.ID = w.history[n-1].ID + 1
+	}
+
+	w.history = append(w.history, e)
+	if len(w.history) > streamHistory {
+		w.history = w.history[1:]
+	}
+
+	for ch := range w.subs {
+		select {
+		case ch <- e:
+		default:
+			// The subscriber isn't keeping up, so it's dropped
+			// rather than left with a gap. Its stream ends and
+			// it resumes with Last-Event-ID when it reconnects.
+			h.drop(id, w, ch)
+		}
+	}
+}
+
+// currentlyPlayingStreamAPI streams the changes of what the given user id
+// is playing as server-sent events.
+func (a *app) currentlyPlayingStreamAPI(w http.ResponseWriter, r *http.Request, id string) {
+	if a.getToken(id) == nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, newErrorAPI(http.StatusNotFound, "not found"))
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, newErrorAPI(http.StatusInternalServerError, "streaming is not supported"))
+		return
+	}
+
+	// The id of the last event the client has seen, it's sent as a
+	// header by the browser when it reconnects.
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	missed, ch, unsubscribe := a.stream.subscribe(id, lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, e := range missed {
+		writeStreamEvent(w, e)
+	}
+	f.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeStreamEvent(w, e)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		f.Flush()
+	}
+}
+
+// writeStreamEvent writes the event in the server-sent events format.
+func writeStreamEvent(w http.ResponseWriter, e *streamEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: currently-playing\ndata: %s\n\n", e.ID, e.Data)
+}
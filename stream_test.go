@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// receive returns the next event on the channel, nil is returned if the
+// channel has been closed.
+func receive(t *testing.T, ch chan *streamEvent) *streamEvent {
+	t.Helper()
+
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+// pollStream polls the watcher of the given user id once.
+func pollStream(a *app, id string) {
+	a.stream.mu.Lock()
+	w := a.stream.watchers[id]
+	a.stream.mu.Unlock()
+
+	a.stream.poll(id, w)
+}
+
+func TestStreamResume(t *testing.T) {
+	a := newTestApp(t, fakeStepTrack, fakeStepTrack, fakeStepEpisode, fakeStepNothing)
+	authorizeTestUser(t, a, "")
+
+	missed, ch, unsubscribe := a.stream.subscribe("alice", 0)
+	defer unsubscribe()
+	if len(missed) != 0 {
+		t.Fatalf("got %d missed events before the first poll", len(missed))
+	}
+	first := receive(t, ch)
+
+	// Unchanged objects aren't broadcasted.
+	pollStream(a, "alice")
+	pollStream(a, "alice")
+	pollStream(a, "alice")
+	second, third := receive(t, ch), receive(t, ch)
+	if string(third.Data) != "null" || second.ID <= first.ID || third.ID <= second.ID {
+		t.Fatalf("got events %d, %d and %d with %s", first.ID, second.ID, third.ID, third.Data)
+	}
+
+	// A resuming client gets the events it has missed, a new client only
+	// gets the current state.
+	missed, _, unsubscribeResumed := a.stream.subscribe("alice", first.ID)
+	defer unsubscribeResumed()
+	if len(missed) != 2 || missed[0] != second || missed[1] != third {
+		t.Errorf("got %d missed events when resuming, want 2", len(missed))
+	}
+
+	missed, _, unsubscribeNew := a.stream.subscribe("alice", 0)
+	defer unsubscribeNew()
+	if len(missed) != 1 || missed[0] != third {
+		t.Errorf("got %d missed events for a new client, want 1", len(missed))
+	}
+}
+
+func TestStreamDropsSlowSubscribers(t *testing.T) {
+	a := newTestApp(t, fakeStepTrack, fakeStepEpisode)
+	authorizeTestUser(t, a, "")
+
+	_, fast, unsubscribeFast := a.stream.subscribe("alice", 0)
+	defer unsubscribeFast()
+	receive(t, fast)
+
+	_, slow, unsubscribeSlow := a.stream.subscribe("alice", 0)
+	defer unsubscribeSlow()
+
+	// The slow subscriber never reads, so its buffer fills up.
+	for i := 0; i < streamHistory+1; i++ {
+		pollStream(a, "alice")
+		receive(t, fast)
+	}
+
+	for i := 0; i < streamHistory; i++ {
+		if e := receive(t, slow); e == nil {
+			t.Fatalf("slow subscriber was closed after %d events", i)
+		}
+	}
+	if e := receive(t, slow); e != nil {
+		t.Fatalf("slow subscriber got event %d, want it closed", e.ID)
+	}
+
+	// The fast subscriber keeps the watcher running.
+	pollStream(a, "alice")
+	if e := receive(t, fast); e == nil {
+		t.Fatal("fast subscriber was closed")
+	}
+
+	// The watcher is stopped once its last subscriber leaves.
+	unsubscribeFast()
+	a.stream.mu.Lock()
+	_, ok := a.stream.watchers["alice"]
+	a.stream.mu.Unlock()
+	if ok {
+		t.Error("watcher is still running without subscribers")
+	}
+}
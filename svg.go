@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Width of the progress bar on the SVG card.
+const svgProgressWidth = 264
+
+// tCardSVG is the template of the SVG card. It's a text template since
+// it's not HTML, so all text has to be escaped with x.
+var tCardSVG = template.Must(template.New("card.svg").Funcs(template.FuncMap{"x": escapeXML}).ParseFS(uiFS, filepath.Join("ui", "card.svg")))
+
+// escapeXML escapes the text so that it can be used in the SVG. Characters
+// that aren't allowed in XML, such as most control characters, are removed
+// since a single one of them makes the whole image invalid.
+func escapeXML(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == 0xfffe || r == 0xffff {
+			return -1
+		}
+		return r
+	}, stripControl(s))
+	return html.EscapeString(s)
+}
+
+// cardTheme contains the colors of a card.
+type cardTheme struct {
+	Background  string
+	Border      string
+	Title       string
+	Text        string
+	Muted       string
+	Accent      string
+	Placeholder string
+}
+
+// cardThemes are the themes that can be selected with the theme parameter,
+// the light theme is used by default.
+var cardThemes = map[string]*cardTheme{
+	"light": {
+		Background:  "#ffffff",
+		Border:      "#e1e4e8",
+		Title:       "#24292e",
+		Text:        "#444d56",
+		Muted:       "#6a737d",
+		Accent:      "#1db954",
+		Placeholder: "#e1e4e8",
+	},
+	"dark": {
+		Background:  "#0d1117",
+		Border:      "#30363d",
+		Title:       "#e6edf3",
+		Text:        "#c9d1d9",
+		Muted:       "#8b949e",
+		Accent:      "#1db954",
+		Placeholder: "#30363d",
+	},
+	"spotify": {
+		Background:  "#121212",
+		Border:      "#1db954",
+		Title:       "#ffffff",
+		Text:        "#b3b3b3",
+		Muted:       "#1db954",
+		Accent:      "#1db954",
+		Placeholder: "#282828",
+	},
+}
+
+// cardThemeFromRequest returns the theme in the theme parameter, the light
+// theme is returned if it isn't set or unknown.
+func cardThemeFromRequest(r *http.Request) *cardTheme {
+	if t, ok := cardThemes[r.FormValue("theme")]; ok {
+		return t
+	}
+	return cardThemes["light"]
+}
+
+// setCardHeaders makes sure that image proxies, such as the one GitHub
+// uses for images in READMEs, don't keep the card around.
+func setCardHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "max-age=0, no-cache, no-store, must-revalidate")
+	w.Header().Set("Expires", "0")
+}
+
+// cardSVG renders the now playing card for the given user id as an SVG
+// image. The album art is embedded so that the image is self-contained.
+func (a *app) cardSVG(w http.ResponseWriter, r *http.Request, id string) {
+	c := a.newCard(w, id)
+
+	image := ""
+	if data, contentType := a.art.get(c.ImageURL); data != nil {
+		image = "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+
+	label := c.State + ": " + c.Title
+	if c.Subtitle != "" {
+		label += " by " + c.Subtitle
+	}
+
+	var b bytes.Buffer
+	err := tCardSVG.Execute(&b, map[string]interface{}{
+		"Card":     c,
+		"Theme":    cardThemeFromRequest(r),
+		"Label":    label,
+		"Title":    truncate(c.Title, 30),
+		"Subtitle": truncate(c.Subtitle, 34),
+		"Image":    image,
+		"Progress": int(c.progress() * svgProgressWidth),
+	})
+	if err != nil {
+		log.Printf("can't render svg card for %s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setCardHeaders(w)
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.WriteHeader(c.Status)
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checkSVG fails the test if the body isn't well-formed XML.
+func checkSVG(t *testing.T, body string) {
+	t.Helper()
+
+	d := xml.NewDecoder(strings.NewReader(body))
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatalf("invalid svg: %v\n%s", err, body)
+		}
+	}
+}
+
+func TestEscapeXML(t *testing.T) {
+	if got, want := escapeXML("Rock & Roll <Live>\x01\ufffe\"'"), "Rock &amp; Roll &lt;Live&gt;&#34;&#39;"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCardSVG(t *testing.T) {
+	a := newTestApp(t)
+	authorizeTestUser(t, a, "")
+	useFakeArt(a)
+
+	cpo := fakeTrack()
+	cpo.Item.Name = "Rock & Roll <Live>\x01"
+	cacheTestObject(a, cpo)
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/~alice.svg?theme=dark", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml; charset=utf-8" {
+		t.Fatalf("got status %d and %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Header().Get("Cache-Control"), "no-cache") {
+		t.Error("the card can be cached")
+	}
+
+	body := w.Body.String()
+	checkSVG(t, body)
+	for _, s := range []string{"Now playing", "Rock &amp; Roll &lt;Live&gt;", "Kraftwerk", "data:image/png;base64,", cardThemes["dark"].Background} {
+		if !strings.Contains(body, s) {
+			t.Errorf("card is missing %q", s)
+		}
+	}
+}
+
+func TestCardSVGNotFound(t *testing.T) {
+	a := newTestApp(t)
+
+	w := serve(a, httptest.NewRequest(http.MethodGet, "/v1/user/bob/card.svg", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	checkSVG(t, w.Body.String())
+	if !strings.Contains(w.Body.String(), "Not on lyssnar yet") {
+		t.Errorf("card doesn't tell that bob isn't on lyssnar:\n%s", w.Body)
+	}
+}
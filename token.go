@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// errNotAuthorized is returned when a token is requested for a user that
+// hasn't authorized lyssnar.
+var errNotAuthorized = errors.New("user is not authorized")
+
+// userLocks serializes the token handling for each user, so that two
+// concurrent requests for the same user don't both refresh the token.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the given user id and returns a function that unlocks it.
+func (l *userLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	m, ok := l.locks[id]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[id] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+// userTokenSource is an oauth2.TokenSource for a stored user token. The
+// token is loaded from the database each time it's requested, if it has
+// expired it's refreshed and the new token, including any rotated refresh
+// token, is written back to the database.
+type userTokenSource struct {
+	a  *app
+	id string
+}
+
+// tokenSource returns a token source for the given user id.
+func (a *app) tokenSource(id string) oauth2.TokenSource {
+	return &userTokenSource{a: a, id: id}
+}
+
+// Token returns a valid token for the user.
+func (s *userTokenSource) Token() (*oauth2.Token, error) {
+	unlock := s.a.tokenLocks.lock(s.id)
+	defer unlock()
+
+	t := s.a.getToken(s.id)
+	if t == nil {
+		return nil, errNotAuthorized
+	}
+	if t.Valid() {
+		return t, nil
+	}
+
+	nt, err := s.a.conf.TokenSource(s.a.spotifyContext(), t).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// Spotify doesn't always return the scope and refresh token when a
+	// token is refreshed, keep the ones we already have in that case.
+	if nt.RefreshToken == "" {
+		nt.RefreshToken = t.RefreshToken
+	}
+	if tokenScope(nt) == "" {
+		nt = nt.WithExtra(map[string]interface{}{"scope": tokenScope(t)})
+	}
+
+	if err := s.a.updateToken(s.id, nt); err != nil {
+		return nil, err
+	}
+
+	return nt, nil
+}
+
+// invalidateToken marks the stored access token for the given user as
+// expired if it still is the given access token, which forces the next
+// request to refresh it. This is used when Spotify rejects an access token
+// before its expiry.
+func (a *app) invalidateToken(id, at string) error {
+	unlock := a.tokenLocks.lock(id)
+	defer unlock()
+
+	t := a.getToken(id)
+	if t == nil || t.AccessToken != at {
+		return nil
+	}
+
+	t.Expiry = time.Now().Add(-time.Minute)
+	return a.updateToken(id, t)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errFetchPanicked is returned to the callers that waited for a fetch that
+// panicked.
+var errFetchPanicked = errors.New("fetching the cached value panicked")
+
+// ttlCache is an in-process cache of values that expire after a while.
+// Concurrent misses for the same key are coalesced into one call to fetch.
+// The cache holds at most size values, zero means that there is no limit.
+type ttlCache[K comparable, V any] struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[K]*ttlCacheEntry[V]
+	calls   map[K]*ttlCacheCall[V]
+}
+
+// ttlCacheEntry is a cached value.
+type ttlCacheEntry[V any] struct {
+	value   V
+	fetched time.Time
+	expires time.Time
+}
+
+// ttlCacheCall is a fetch that is in flight.
+type ttlCacheCall[V any] struct {
+	wg      sync.WaitGroup
+	value   V
+	fetched time.Time
+	err     error
+}
+
+// newTTLCache returns an empty cache that holds at most size values.
+func newTTLCache[K comparable, V any](size int) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		size:    size,
+		entries: make(map[K]*ttlCacheEntry[V]),
+		calls:   make(map[K]*ttlCacheCall[V]),
+	}
+}
+
+// get returns the cached value for the given key, or calls fetch if there
+// is no fresh value in the cache. Fetch returns the value and how long it's
+// kept, values that are kept for zero time and errors aren't stored. The
+// cache status and when the returned value was fetched are returned as
+// well.
+func (c *ttlCache[K, V]) get(key K, fetch func() (V, time.Duration, error)) (V, string, time.Time, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			return e.value, cacheHit, e.fetched, nil
+		}
+		delete(c.entries, key)
+	}
+
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.value, cacheCollapsed, call.fetched, call.err
+	}
+
+	call := &ttlCacheCall[V]{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	c.do(key, call, fetch)
+	return call.value, cacheMiss, call.fetched, call.err
+}
+
+// do calls fetch and stores the result. The waiting callers are released
+// even if fetch panics, they get errFetchPanicked while the panic continues
+// in the caller that called fetch.
+func (c *ttlCache[K, V]) do(key K, call *ttlCacheCall[V], fetch func() (V, time.Duration, error)) {
+	var ttl time.Duration
+	completed := false
+	defer func() {
+		if !completed {
+			var zero V
+			call.value, call.err = zero, errFetchPanicked
+		}
+		call.fetched = time.Now()
+
+		c.mu.Lock()
+		delete(c.calls, key)
+		if call.err == nil && ttl > 0 {
+			c.evict()
+			c.entries[key] = &ttlCacheEntry[V]{value: call.value, fetched: call.fetched, expires: call.fetched.Add(ttl)}
+		}
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.value, ttl, call.err = fetch()
+	completed = true
+}
+
+// evict makes room for a new value when the cache is full, expired values
+// are evicted first and an arbitrary value if that isn't enough. c.mu must
+// be held.
+func (c *ttlCache[K, V]) evict() {
+	if c.size == 0 || len(c.entries) < c.size {
+		return
+	}
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -14,6 +15,9 @@ import (
 //go:embed ui
 var uiFS embed.FS
 
+// Number of recently played tracks that are listed on the user's page.
+const recentlyPlayedOnPage = 5
+
 // Collection of templates and data.
 var (
 	dCss              string
@@ -22,6 +26,7 @@ var (
 	dFavicon32        string
 	tAuthorized       = template.Must(template.ParseFS(uiFS, filepath.Join("ui", "authorized.html")))
 	tCurrentlyPlaying = template.Must(template.ParseFS(uiFS, filepath.Join("ui", "currently-playing.html")))
+	tEmbed            = template.Must(template.ParseFS(uiFS, filepath.Join("ui", "embed.html")))
 	tError            = template.Must(template.ParseFS(uiFS, filepath.Join("ui", "error.html")))
 	tLanding          = template.Must(template.ParseFS(uiFS, filepath.Join("ui", "landing.html")))
 )
@@ -57,8 +62,57 @@ func (a *app) landing(w http.ResponseWriter, r *http.Request) {
 	tLanding.Execute(w, nil)
 }
 
+// authorize binds a new state and PKCE verifier to the browser and
+// redirects the user to the authorization page at Spotify. A default short
+// format can be passed in the short_format parameter and the origins that
+// may embed the widget in the frame_ancestors parameter, the user is asked
+// to confirm them once authorized.
+func (a *app) authorize(w http.ResponseWriter, r *http.Request) {
+	s := &oauthState{
+		State:     newUUID(),
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(stateLifetime),
+	}
+
+	if r.URL.Query().Has("short_format") {
+		format := r.URL.Query().Get("short_format")
+		if _, err := parseShortFormat(format); err != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			tError.Execute(w, map[string]string{"header": ":-(", "message": fmt.Sprintf("The short format is invalid: %v", err)})
+			return
+		}
+		s.ShortFormat = &format
+	}
+
+	if r.URL.Query().Has("frame_ancestors") {
+		ancestors, err := parseFrameAncestors(r.URL.Query().Get("frame_ancestors"))
+		if err != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			tError.Execute(w, map[string]string{"header": ":-(", "message": fmt.Sprintf("The frame ancestors are invalid: %v", err)})
+			return
+		}
+		s.FrameAncestors = &ancestors
+	}
+	a.setStateCookie(w, s)
+
+	http.Redirect(w, r, a.conf.AuthCodeURL(s.State, oauth2.S256ChallengeOption(s.Verifier)), http.StatusTemporaryRedirect)
+}
+
 // callback handles the response from the authorization page at Spotify.
 func (a *app) callback(w http.ResponseWriter, r *http.Request) {
+	// Make sure that the callback belongs to an authorization that was
+	// initiated by this browser. The state can only be used once.
+	s, err := a.verifyState(r)
+	a.clearStateCookie(w)
+	if err != nil {
+		log.Printf("invalid oauth state: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		tError.Execute(w, map[string]string{"header": ":-(", "message": "The authorization request is invalid or has expired, try again."})
+		return
+	}
+
 	// Make sure we didn't get an error back from Spotify.
 	if r.FormValue("error") != "" {
 		tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
@@ -66,90 +120,229 @@ func (a *app) callback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Exchange the code for a token.
-	t, err := a.conf.Exchange(oauth2.NoContext, r.FormValue("code"))
+	t, err := a.conf.Exchange(a.spotifyContext(), r.FormValue("code"), oauth2.VerifierOption(s.Verifier))
 	if err != nil {
 		tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
 		return
 	}
 
 	// Get the user fro
-	u, err := a.getUserObject(t.AccessToken, t.RefreshToken)
+	u, err := a.getUserObject(t)
 	if err != nil {
 		tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
 		return
 	}
 
-	// Store the access and refresh tokens in our database.
-	a.storeTokens(u.ID, t.AccessToken, t.RefreshToken)
+	// Store the token in our database.
+	a.storeToken(u.ID, t)
+
+	// Settings that were passed to /authorize aren't stored until the
+	// user confirms them, the link may have been crafted by someone else.
+	// The page can't be framed so that the user can't be tricked into
+	// confirming them either.
+	data := map[string]interface{}{"id": u.ID}
+	if s.ShortFormat != nil || s.FrameAncestors != nil {
+		p := &pendingSettings{
+			UserID:         u.ID,
+			ShortFormat:    s.ShortFormat,
+			FrameAncestors: s.FrameAncestors,
+			ExpiresAt:      time.Now().Add(settingsLifetime),
+		}
+		data["settings"] = describeSettings(p)
+		data["token"] = a.settingsToken(p)
+	}
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
 
 	// Render the output.
-	tAuthorized.Execute(w, map[string]string{"id": u.ID})
+	tAuthorized.Execute(w, data)
 }
 
 // currentlyPlaying displays what the requested user currently is playing.
 func (a *app) currentlyPlaying(w http.ResponseWriter, r *http.Request, id string) {
-	// Get the access and refresh tokens from the database for
-	// the given user.
-	// If the tokens are empty we'll know that the user hasn't authorized
+	// Get the currently playing object for the requested user id.
+	// The object is served from the cache if it has been fetched
+	// recently, and the last known object is served if Spotify can't
+	// be reached.
+	cpo, fetchedAt, stale, err := a.currentlyPlayingObjectOrStale(w, id)
+
+	// If there is no token we'll know that the user hasn't authorized
 	// his/her account.
-	at, rt := a.getTokens(id)
-	if at == "" {
+	if err == errNotAuthorized {
 		tError.Execute(w, map[string]string{"header": ":-(", "message": "The account is not authorized on lyssnar.com yet"})
 		return
 	}
 
-	// Get the currently playing object for the requested user id.
-	cpo, err := a.getCurrentlyPlayingObject(id, at, rt)
+	if writeUnavailable(w, err) {
+		tError.Execute(w, map[string]string{"header": ":-(", "message": "Spotify is temporarily unavailable, try again in a little while."})
+		return
+	}
+
 	if err != nil {
 		tError.Execute(w, map[string]string{"header": ":-(", "message": "An error occured, try again later."})
 		return
 	}
 
-	// This case means that the user isn't currently playing anything.
+	// This case means that the user isn't currently playing anything,
+	// show the last item the user played instead if there is one.
 	if cpo == nil && err == nil {
-		tError.Execute(w, map[string]string{"header": "Not active", "message": fmt.Sprintf("%s is not using Spotify right now", id)})
+		p, err := a.getLastPlay(id)
+		if err != nil {
+			log.Printf("can't get last play for %s: %v", id, err)
+		}
+		if p == nil {
+			tError.Execute(w, map[string]string{"header": "Not active", "message": fmt.Sprintf("%s is not using Spotify right now", id)})
+			return
+		}
+
+		data := map[string]interface{}{
+			"id":         id,
+			"artist":     p.Artists,
+			"track":      p.Name,
+			"url":        p.URL,
+			"image":      p.ImageURL,
+			"lastPlayed": timeAgo(time.Since(p.UpdatedAt)),
+		}
+		data["meta"] = a.newPageMeta(id, fmt.Sprintf("%s last listened to %s - %s, %s", id, p.Artists, p.Name, data["lastPlayed"]))
+		t := a.getToken(id)
+		addReauthorize(data, t)
+		a.addRecentlyPlayed(data, id, t)
+		tCurrentlyPlaying.Execute(w, data)
 		return
 	}
 
-	if cpo.Item.Type == "track" {
-		// Handle tracks
-		imageURL := ""
-		for _, i := range cpo.Item.Album.Images {
-			if i.Height > 200 && i.Height < 500 {
-				imageURL = i.URL
-			}
+	// Tell the visitor how old the information is if Spotify couldn't
+	// be reached.
+	staleText := ""
+	if stale != nil {
+		staleText = timeAgo(stale.age())
+	}
+
+	// Ads and unknown items can't be described, tell the visitor what
+	// kind of item it is instead.
+	data := map[string]interface{}{
+		"id":    id,
+		"stale": staleText,
+	}
+	if item := newPlayingItem(cpo); item != nil {
+		data["artist"] = item.Artists
+		data["track"] = item.Name
+		data["url"] = item.URL
+		data["image"] = item.Image
+	} else {
+		data["kind"] = undescribedItemText(cpo)
+	}
+
+	// Describe the page for link previews in chat apps and social media.
+	verb := "is listening to"
+	if stale != nil {
+		verb = "was listening to"
+	}
+	if kind, ok := data["kind"]; ok {
+		data["meta"] = a.newPageMeta(id, fmt.Sprintf("%s %s %s", id, verb, kind))
+	} else {
+		data["meta"] = a.newPageMeta(id, fmt.Sprintf("%s %s %s - %s", id, verb, data["artist"], data["track"]))
+	}
+
+	// Show how far into the episode the user is, together with the show
+	// notes and a link that continues from the same position.
+	if e := newEpisodeAPI(cpo, fetchedAt, time.Now()); e != nil {
+		data["episode"] = map[string]interface{}{
+			"description": e.Description,
+			"released":    formatReleaseDate(e.ReleaseDate),
+			"position":    formatPosition(e.ProgressMS),
+			"duration":    formatPosition(e.DurationMS),
+			"percent":     e.ProgressPercent,
+			"remaining":   formatRemaining(e.RemainingMS),
+			"link":        e.DeepLink,
 		}
+	}
+
+	// Tell the visitor where the user is listening, this is only known
+	// if the user has granted access to the playback state.
+	data["device"] = deviceName(cpo.Device)
+	data["shuffle"] = cpo.ShuffleState != nil && *cpo.ShuffleState
+	if cpo.RepeatState != "off" {
+		data["repeat"] = cpo.RepeatState
+	}
 
-		artists := ""
-		for _, a := range cpo.Item.Artists {
-			if artists == "" {
-				artists = a.Name
-			} else {
-				artists = fmt.Sprintf("%s, %s", artists, a.Name)
-			}
+	// The features the user has to re-authorize to enable are listed
+	// even if Spotify can't be reached, they only depend on the stored
+	// token.
+	t := a.getToken(id)
+	addReauthorize(data, t)
+
+	// There's no point in asking Spotify for the context or the recently
+	// played tracks if it couldn't be reached a moment ago.
+	if stale == nil {
+		pc, err := a.resolveContext(id, cpo.Context)
+		if err != nil {
+			log.Printf("can't resolve context for %s: %v", id, err)
+		}
+		if pc != nil {
+			data["context"] = pc
 		}
+		a.addRecentlyPlayed(data, id, t)
+	}
+	tCurrentlyPlaying.Execute(w, data)
+}
 
-		tCurrentlyPlaying.Execute(w, map[string]string{
-			"id":     id,
-			"artist": artists,
-			"track":  cpo.Item.Name,
-			"url":    cpo.Item.ExternalURLs["spotify"],
-			"image":  imageURL,
-		})
-	} else {
-		// Handle episodes.
-		imageURL := ""
-		for _, i := range cpo.Item.Show.Images {
-			if i.Height > 200 && i.Height < 500 {
-				imageURL = i.URL
-			}
+// addReauthorize adds the features that the user of the given token has to
+// re-authorize to enable to the template data, if any.
+func addReauthorize(data map[string]interface{}, t *oauth2.Token) {
+	if t == nil {
+		return
+	}
+	data["reauthorize"] = missingFeatureDescriptions(t)
+}
+
+// addRecentlyPlayed adds the tracks that the given user id has played
+// recently to the template data, t is the user's token.
+func (a *app) addRecentlyPlayed(data map[string]interface{}, id string, t *oauth2.Token) {
+	if t == nil || !featureRecentlyPlayed.enabled(t) {
+		return
+	}
+
+	rpo, err := a.cachedRecentlyPlayedObject(nil, id, recentlyPlayedOnPage, "", "")
+	if err != nil {
+		log.Printf("can't get recently played for %s: %v", id, err)
+		return
+	}
+
+	var recent []map[string]string
+	for _, i := range rpo.Items {
+		ago := ""
+		if playedAt, err := time.Parse(time.RFC3339, i.PlayedAt); err == nil {
+			ago = timeAgo(time.Since(playedAt))
 		}
-		tCurrentlyPlaying.Execute(w, map[string]string{
-			"id":     id,
-			"artist": cpo.Item.Show.Name,
-			"track":  cpo.Item.Name,
-			"url":    cpo.Item.Show.ExternalURLs["spotify"],
-			"image":  imageURL,
+
+		recent = append(recent, map[string]string{
+			"artist": artistNames(i.Track.Artists),
+			"track":  i.Track.Name,
+			"url":    i.Track.ExternalURLs["spotify"],
+			"ago":    ago,
 		})
 	}
+	data["recent"] = recent
+}
+
+// timeAgo formats the duration as a human readable relative time, e.g.
+// "12 minutes ago".
+func timeAgo(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d.Hours()), "hour")
+	}
+	return plural(int(d.Hours()/24), "day")
 }